@@ -3,8 +3,11 @@ package main
 import (
 	"crypto/tls"
 	"encoding/binary"
+	"encoding/json"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/chmike/go-dmon/dmon"
@@ -29,11 +32,43 @@ func runAsClient() {
 		Message:   "no problem",
 	}
 	statStart(time.Duration(*periodFlag) * time.Second)
-	lms := &MsgLogSrv{Address: *addressFlag}
+	if network, address := splitAddress(*addressFlag); network == "udp" {
+		lu := &MsgLogUDP{
+			Address: address,
+			MTU:     *mtuFlag,
+			Delay:   10 * time.Millisecond,
+		}
+		for {
+			m.Stamp = time.Now().UTC()
+			n := lu.SendMessage(&m)
+			if err := lu.Error(); err != nil {
+				log.Printf("send message: %+v, wait 2 seconds", err)
+				time.Sleep(2 * time.Second)
+			}
+			statUpdate(n)
+		}
+	}
+	lms := &MsgLogSrv{
+		Address:   *addressFlag,
+		Window:    *windowFlag,
+		Handshake: *handshakeFlag,
+		Name:      *nameFlag,
+		Heartbeat: time.Duration(*heartbeatFlag) * time.Second,
+	}
+	if *jsonFlag {
+		lms.Codecs = []string{"json", "binary"}
+	} else {
+		lms.Codecs = []string{"binary", "json"}
+	}
+	if *compressFlag {
+		lms.Compression = []string{"deflate", "none"}
+	}
 	for {
 		m.Stamp = time.Now().UTC()
 		n := lms.SendMessage(&m)
-		if lms.err != nil {
+		if _, ok := lms.err.(*ReplyError); ok {
+			log.Printf("send message: %v", lms.err)
+		} else if lms.err != nil {
 			log.Printf("send message: %+v, wait 2 seconds", lms.err)
 			time.Sleep(2 * time.Second)
 		}
@@ -42,10 +77,92 @@ func runAsClient() {
 }
 
 // MsgLogSrv holds a cached connection to the logging server.
+//
+// With a zero Window, each message waits for its acknowledgment before
+// SendMessage returns. Otherwise up to Window sequenced messages may be in
+// flight, and the server acknowledges them cumulatively. In both cases, the
+// messages not yet acknowledged are sent again after a reconnect.
+//
+// A message rejected by the server is sent again after the requested delay
+// when its status allows it. Otherwise it is dropped, and the rejection is
+// returned by Error as a *ReplyError without closing the connection. When
+// the server is going away, the connection is closed and the messages not
+// yet acknowledged are sent again after a reconnect.
+//
+// TLS is used on tcp connections when TLS or the -tls flag is set.
+//
+// With Handshake set, each connection starts by negotiating the protocol
+// version, the codec and the compression among those listed in Codecs and
+// Compression, in order of preference. Otherwise the codec is selected by
+// the -json flag, as on the server.
+//
+// When Heartbeat is not zero and a handshake was made, a ping frame is sent
+// on connections idle for Heartbeat. A connection on which the server stays
+// silent for longer than Heartbeat plus the I/O timeout is closed.
+//
+// When the server asks to slow down, a delay is inserted before sending each
+// message. It follows the requested delay when it increases, and decreases
+// progressively when the server asks to resume.
 type MsgLogSrv struct {
-	Address string
-	conn    net.Conn
-	err     error
+	Address     string
+	Window      int
+	Handshake   bool
+	Name        string
+	Codecs      []string
+	Compression []string
+	Heartbeat   time.Duration
+	TLS         bool
+	conn        *link
+	err         error
+	rejected    error
+	seq         uint64
+	pending     []sentMsg
+	codec       string
+	zip         *compressor
+	tmp         []byte
+	pace        time.Duration
+}
+
+// link is a connection to the logging server shared with its reader and
+// heartbeat goroutines.
+type link struct {
+	net.Conn
+	mtx       sync.Mutex // serializes writes
+	lastWrite time.Time
+	lastRecv  int64 // unix nano time of the last frame received
+	pace      int64 // delay between messages requested by the server
+	acks      chan ackInfo
+	done      chan struct{}
+}
+
+// maxRetries is the maximum number of times a rejected message is sent again.
+const maxRetries = 5
+
+// retryDelay is the delay before sending again a rejected message when the
+// server did not specify one.
+const retryDelay = time.Second
+
+// maxRetryDelay is the maximum delay before sending again a rejected message,
+// whatever the delay requested by the server.
+const maxRetryDelay = 10 * time.Second
+
+// sentMsg is a message frame waiting for its acknowledgment. The message is
+// kept to encode it again with the options of a new connection.
+type sentMsg struct {
+	seq     uint64
+	msg     dmon.Msg
+	buf     []byte
+	retries int
+}
+
+// ackInfo is an acknowledgment or a rejection received from the server.
+type ackInfo struct {
+	seq   uint64
+	reply *ReplyError
+	pong  bool
+	flow  bool
+	pace  time.Duration
+	err   error
 }
 
 // Error returns the last error.
@@ -57,93 +174,404 @@ func (lms *MsgLogSrv) Error() error {
 func (lms *MsgLogSrv) SendMessage(m *dmon.Msg) (n int) {
 	defer func() {
 		if lms.conn != nil && lms.err != nil {
-			lms.conn.Close()
-			lms.conn = nil
+			lms.close()
+		}
+		if lms.err == nil {
+			lms.err, lms.rejected = lms.rejected, nil
 		}
 	}()
 
-	if lms.conn == nil || lms.err != nil {
+	lms.err = nil
+	if lms.conn == nil {
 		lms.tryConnect()
 	}
-	if lms.conn == nil || lms.err != nil {
+	if lms.conn == nil {
 		return 0
 	}
 
-	// encode message
-	buf := make([]byte, 8, 512)
-	if *jsonFlag {
-		buf, lms.err = m.JSONEncode(buf)
-	} else {
-		buf, lms.err = m.BinaryEncode(buf)
+	// wait for a free slot in the window
+	for len(lms.pending) >= lms.window() {
+		lms.waitAck()
+		if lms.err != nil {
+			return 0
+		}
 	}
-	if lms.err != nil {
-		lms.err = errors.Wrap(lms.err, "send message")
-		return 0
+
+	// pace messages as requested by the server
+	if target := time.Duration(atomic.LoadInt64(&lms.conn.pace)); target >= lms.pace {
+		lms.pace = target
+	} else if lms.pace = (7*lms.pace + target) / 8; lms.pace < time.Microsecond {
+		lms.pace = 0
+	}
+	if lms.pace > 0 {
+		time.Sleep(lms.pace)
 	}
 
-	// set message header
-	copy(buf[:4], []byte("DMON"))
-	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(buf)-8))
+	// encode message
+	buf, err := lms.encode(m, lms.seq+1)
+	if err != nil {
+		lms.err = errors.Wrap(err, "send message")
+		return 0
+	}
 
 	// send message
-	lms.err = lms.conn.SetWriteDeadline(time.Now().Add(timeOutDelay))
+	lms.seq++
+	lms.pending = append(lms.pending, sentMsg{seq: lms.seq, msg: *m, buf: buf})
+	lms.err = lms.write(buf)
 	if lms.err != nil {
 		lms.err = errors.Wrap(lms.err, "send message")
 		return 0
 	}
 
-	n, lms.err = lms.conn.Write(buf)
-	if lms.err != nil {
-		lms.err = errors.Wrap(lms.err, "send message")
-		return 0
+	// receive acknowledgment
+	if lms.Window == 0 {
+		for len(lms.pending) > 0 && lms.err == nil {
+			lms.waitAck()
+		}
+		if lms.err != nil || lms.rejected != nil {
+			return 0
+		}
+	}
+	return len(buf)
+}
+
+// Flush waits until all sent messages are acknowledged or rejected.
+func (lms *MsgLogSrv) Flush() error {
+	lms.err = nil
+	for len(lms.pending) > 0 {
+		if lms.conn == nil {
+			lms.tryConnect()
+			if lms.conn == nil {
+				return lms.err
+			}
+		}
+		lms.waitAck()
+		if lms.err != nil {
+			lms.close()
+			return lms.err
+		}
+	}
+	lms.err, lms.rejected = lms.rejected, nil
+	return lms.err
+}
+
+// encode returns the frame of message m with sequence number seq.
+func (lms *MsgLogSrv) encode(m *dmon.Msg, seq uint64) ([]byte, error) {
+	var err error
+	magic, bufLen := msgMagic, hdrLen
+	if lms.Window > 0 {
+		magic, bufLen = seqMsgMagic, hdrLen+seqLen
+	}
+	buf := make([]byte, bufLen, 512)
+	if lms.zip == nil {
+		buf, err = codecs[lms.codec].encode(m, buf)
+	} else if lms.tmp, err = codecs[lms.codec].encode(m, lms.tmp[:0]); err == nil {
+		buf, err = lms.zip.compress(buf, lms.tmp)
+	}
+	if err != nil {
+		return nil, err
+	}
+	setHeader(buf, magic)
+	if lms.Window > 0 {
+		binary.LittleEndian.PutUint64(buf[hdrLen:], seq)
+	}
+	return buf, nil
+}
+
+// window returns the maximum number of messages waiting for an acknowledgment.
+func (lms *MsgLogSrv) window() int {
+	if lms.Window > 0 {
+		return lms.Window
+	}
+	return 1
+}
+
+// write writes buf to the connection.
+func (lms *MsgLogSrv) write(buf []byte) error {
+	return lms.conn.write(buf)
+}
+
+// waitAck waits for the next acknowledgment and removes the acknowledged
+// messages from the pending list.
+func (lms *MsgLogSrv) waitAck() {
+	var a ackInfo
+	select {
+	case a = <-lms.conn.acks:
+	case <-time.After(timeOutDelay):
+		a.err = errors.New("timeout")
+	}
+	if a.err != nil {
+		lms.err = errors.Wrap(a.err, "recv acknowledgment")
+		return
+	}
+	if a.reply != nil && a.reply.Status == StatusGoingAway {
+		lms.err = errors.Wrap(a.reply, "recv acknowledgment")
+		return
+	}
+	if a.reply != nil {
+		lms.reject(a.reply)
+		return
+	}
+	i := 0
+	if lms.Window == 0 {
+		i = 1
+	} else {
+		for i < len(lms.pending) && lms.pending[i].seq <= a.seq {
+			i++
+		}
+	}
+	lms.pending = append(lms.pending[:0], lms.pending[i:]...)
+}
+
+// reject handles the rejection e of a pending message. The message is sent
+// again after the requested delay when the status allows it, and dropped
+// otherwise.
+func (lms *MsgLogSrv) reject(e *ReplyError) {
+	i := 0
+	if lms.Window > 0 {
+		for i < len(lms.pending) && lms.pending[i].seq != e.Seq {
+			i++
+		}
+	}
+	if i == len(lms.pending) {
+		return
+	}
+	p := lms.pending[i]
+	lms.pending = append(lms.pending[:i], lms.pending[i+1:]...)
+	if !e.Status.Retry() || p.retries >= maxRetries {
+		lms.rejected = e
+		return
+	}
+	delay := e.RetryAfter
+	if delay <= 0 {
+		delay = retryDelay
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	time.Sleep(delay)
+	p.retries++
+	if lms.Window > 0 {
+		lms.seq++
+		p.seq = lms.seq
+		binary.LittleEndian.PutUint64(p.buf[hdrLen:], p.seq)
+	}
+	lms.pending = append(lms.pending, p)
+	if lms.err = lms.write(p.buf); lms.err != nil {
+		lms.err = errors.Wrap(lms.err, "resend message")
+	}
+}
+
+// Close closes the connection to the server without waiting for the
+// acknowledgment of the sent messages.
+func (lms *MsgLogSrv) Close() error {
+	if lms.conn == nil {
+		return nil
+	}
+	lms.close()
+	return nil
+}
+
+func (lms *MsgLogSrv) close() {
+	close(lms.conn.done)
+	lms.conn.Close()
+	lms.conn = nil
+}
+
+// write writes buf to the connection.
+func (l *link) write(buf []byte) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	err := l.SetWriteDeadline(time.Now().Add(timeOutDelay))
+	if err != nil {
+		return err
+	}
+	n, err := l.Write(buf)
+	if err != nil {
+		return err
 	}
 	if n != len(buf) {
-		lms.err = errors.Errorf("short write: expected %d, got %d", len(buf), n)
-		lms.err = errors.Wrap(lms.err, "send message")
-		return 0
+		return errors.Errorf("short write: expected %d, got %d", len(buf), n)
 	}
+	l.lastWrite = time.Now()
+	return nil
+}
 
-	// receive acknowledgment
-	var b [1]byte
-	lms.err = lms.conn.SetReadDeadline(time.Now().Add(timeOutDelay))
-	if lms.err != nil {
-		lms.err = errors.Wrap(lms.err, "recv acknowledgment")
-		return 0
+// readAcks forwards the acknowledgments read from r to acks until an error
+// occurs or done is closed. Pong frames are only recorded as a sign of life.
+func (l *link) readAcks(r *dmon.BufReader) {
+	for {
+		a := readAck(r)
+		atomic.StoreInt64(&l.lastRecv, time.Now().UnixNano())
+		if a.flow {
+			atomic.StoreInt64(&l.pace, int64(a.pace))
+			if a.pace > 0 {
+				statThrottled.inc()
+			}
+			continue
+		}
+		if a.pong {
+			continue
+		}
+		select {
+		case l.acks <- a:
+		case <-l.done:
+			return
+		}
+		if a.err != nil {
+			return
+		}
 	}
-	n, lms.err = lms.conn.Read(b[:])
-	if n != 1 {
-		if lms.err != nil {
-			lms.err = errors.Wrap(lms.err, "recv acknowledgment")
-			return 0
+}
+
+// heartbeat sends a ping frame when nothing was written during period, and
+// closes the connection when nothing was received during period plus the
+// I/O timeout.
+func (l *link) heartbeat(period time.Duration) {
+	ping := make([]byte, hdrLen)
+	setHeader(ping, pingMagic)
+	ticker := time.NewTicker(period / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		}
+		if time.Since(time.Unix(0, atomic.LoadInt64(&l.lastRecv))) > period+timeOutDelay {
+			log.Println("heartbeat: server not responding, closing connection")
+			l.Close()
+			return
+		}
+		l.mtx.Lock()
+		idle := time.Since(l.lastWrite)
+		l.mtx.Unlock()
+		if idle >= period {
+			if err := l.write(ping); err != nil {
+				log.Println("heartbeat:", err)
+				l.Close()
+				return
+			}
 		}
-		lms.err = errors.Errorf("expected 1 byte, got %d", n)
-		lms.err = errors.Wrap(lms.err, "recv acknowledgment")
-		return 0
 	}
-	if b[0] != ackCode {
-		lms.err = errors.Errorf("expected ack byte %+X, got %+X", ackCode, b[0])
-		lms.err = errors.Wrap(lms.err, "recv acknowledgment")
-		return 0
+}
+
+// dial returns a connection to the server at addr, using TLS on tcp when
+// useTLS is set.
+func dial(addr string, useTLS bool) (net.Conn, error) {
+	network, address := splitAddress(addr)
+	var config *tls.Config
+	if (useTLS && network == "tcp") || network == "wss" {
+		clientCert, err := tls.LoadX509KeyPair(clientCRTFilename, clientKeyFilename)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not load X509 certificate")
+		}
+		config = &tls.Config{
+			Certificates:       []tls.Certificate{clientCert},
+			InsecureSkipVerify: !serverDNSNameCheck,
+		}
 	}
-	return len(buf)
+	switch {
+	case network == "ws" || network == "wss":
+		return dialWebSocket(address, config)
+	case config != nil:
+		return tls.Dial(network, address, config)
+	}
+	return net.Dial(network, address)
 }
 
 func (lms *MsgLogSrv) tryConnect() {
-	var err error
-	if *tlsFlag {
-		var clientCert tls.Certificate
-		clientCert, err = tls.LoadX509KeyPair(clientCRTFilename, clientKeyFilename)
-		if err != nil {
+	var conn net.Conn
+	conn, lms.err = dial(lms.Address, *tlsFlag || lms.TLS)
+	if lms.err != nil {
+		return
+	}
+	lms.conn = &link{
+		Conn:     conn,
+		lastRecv: time.Now().UnixNano(),
+		acks:     make(chan ackInfo, 1),
+		done:     make(chan struct{}),
+	}
+	r := dmon.NewBufReader(conn, 512)
+	lms.codec, lms.zip = defaultCodec(), nil
+	if lms.Handshake {
+		if lms.err = lms.handshake(r); lms.err != nil {
+			lms.err = errors.Wrap(lms.err, "handshake")
+			lms.conn.Close()
 			lms.conn = nil
-			lms.err = errors.Wrapf(err, "could not load X509 certificate")
 			return
 		}
-		config := tls.Config{
-			Certificates:       []tls.Certificate{clientCert},
-			InsecureSkipVerify: !serverDNSNameCheck,
+	}
+	go lms.conn.readAcks(r)
+	if lms.Handshake && lms.Heartbeat > 0 {
+		go lms.conn.heartbeat(lms.Heartbeat)
+	}
+
+	// resend the messages not yet acknowledged
+	for i := range lms.pending {
+		p := &lms.pending[i]
+		if p.buf, lms.err = lms.encode(&p.msg, p.seq); lms.err == nil {
+			lms.err = lms.write(p.buf)
 		}
-		lms.conn, lms.err = tls.Dial("tcp", *addressFlag, &config)
-	} else {
-		lms.conn, lms.err = net.Dial("tcp", *addressFlag)
+		if lms.err != nil {
+			lms.err = errors.Wrap(lms.err, "resend message")
+			lms.close()
+			return
+		}
+	}
+}
+
+// handshake sends the client options and sets the ones chosen by the server.
+func (lms *MsgLogSrv) handshake(r *dmon.BufReader) error {
+	h := hello{
+		Version:     protocolVersion,
+		Codecs:      lms.Codecs,
+		Compression: lms.Compression,
+		Name:        lms.Name,
+	}
+	if len(h.Codecs) == 0 {
+		h.Codecs = []string{defaultCodec()}
+	}
+	data, err := json.Marshal(&h)
+	if err != nil {
+		return err
+	}
+	buf := append(make([]byte, hdrLen, hdrLen+len(data)), data...)
+	setHeader(buf, helloMagic)
+	if err = lms.write(buf); err != nil {
+		return err
+	}
+
+	var hdr [hdrLen]byte
+	lms.conn.SetReadDeadline(time.Now().Add(timeOutDelay))
+	defer lms.conn.SetReadDeadline(time.Time{})
+	magic, dataLen, err := readHeader(r, hdr[:])
+	if err != nil {
+		return err
+	}
+	if (magic != helloMagic && magic != replyMagic) || dataLen > maxReplyLen {
+		return errors.Errorf("expected '%s' frame, got '%s' with %d bytes", helloMagic, magic, dataLen)
+	}
+	data = make([]byte, dataLen)
+	if _, err = r.ReadFull(data); err != nil {
+		return err
+	}
+	if magic == replyMagic {
+		if e := parseReply(data); e != nil {
+			return e
+		}
+		return errors.New("invalid reply frame")
+	}
+	var w welcome
+	if err = json.Unmarshal(data, &w); err != nil {
+		return err
+	}
+	if _, ok := codecs[w.Codec]; !ok {
+		return errors.Errorf("unsupported codec '%s'", w.Codec)
+	}
+	lms.codec = w.Codec
+	if w.Compression == "deflate" {
+		lms.zip = &compressor{}
 	}
+	return nil
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chmike/go-dmon/dmon"
+	"github.com/pkg/errors"
+)
+
+// readSeqMsg reads a message frame with a sequence number from r, and
+// returns the sequence number and the message text.
+func readSeqMsg(r *dmon.BufReader) (uint64, string, error) {
+	var hdr [hdrLen]byte
+	magic, dataLen, err := readHeader(r, hdr[:])
+	if err != nil {
+		return 0, "", err
+	}
+	if magic != seqMsgMagic || dataLen < seqLen {
+		return 0, "", errors.Errorf("got '%s' frame with %d bytes", magic, dataLen)
+	}
+	buf := make([]byte, dataLen)
+	if _, err = r.ReadFull(buf); err != nil {
+		return 0, "", err
+	}
+	var m dmon.Msg
+	if err = codecs[defaultCodec()].decode(&m, buf[seqLen:]); err != nil {
+		return 0, "", err
+	}
+	return binary.LittleEndian.Uint64(buf), m.Message, nil
+}
+
+// TestClientWindow checks that a client with a window sends no more messages
+// than its window before an acknowledgment, trims its pending messages with
+// the cumulative acknowledgments, and sends again the unacknowledged ones
+// after a reconnection, so that every message is stored exactly once.
+func TestClientWindow(t *testing.T) {
+	defer func(d time.Duration) { timeOutDelay = d }(timeOutDelay)
+	timeOutDelay = 2 * time.Second
+	const window, n = 4, 20
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// the server stores the messages it acknowledges
+	var stored []string
+	done := make(chan error, 1)
+	go func() {
+		// acknowledge up to 4 cumulatively, then drop the connection with a
+		// full window of unacknowledged messages
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		r := dmon.NewBufReader(conn, 4096)
+		var received []string
+		for want := uint64(1); want <= 2*window; want++ {
+			seq, text, err := readSeqMsg(r)
+			if err != nil || seq != want {
+				conn.Close()
+				done <- errors.Errorf("first connection: got message %d, error %v, expected %d", seq, err, want)
+				return
+			}
+			received = append(received, text)
+			if seq == 2 || seq == window {
+				stored = append(stored, received...)
+				received = received[:0]
+				sendFrame(conn, newAckFrame(seq))
+			}
+		}
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if seq, _, err := readSeqMsg(r); err == nil {
+			conn.Close()
+			done <- errors.Errorf("first connection: got message %d beyond the window", seq)
+			return
+		}
+		conn.Close()
+
+		// the unacknowledged messages come first on the next connection
+		if conn, err = ln.Accept(); err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		r = dmon.NewBufReader(conn, 4096)
+		for want := uint64(window + 1); want <= n; want++ {
+			seq, text, err := readSeqMsg(r)
+			if err != nil || seq != want {
+				done <- errors.Errorf("second connection: got message %d, error %v, expected %d", seq, err, want)
+				return
+			}
+			stored = append(stored, text)
+			sendFrame(conn, newAckFrame(seq))
+		}
+		done <- nil
+	}()
+
+	lms := &MsgLogSrv{Address: ln.Addr().String(), Window: window}
+	for i := 1; i <= n; i++ {
+		m := dmon.Msg{Stamp: time.Now(), Level: "info", System: "test", Component: "client", Message: fmt.Sprint("msg ", i)}
+		for tries := 1; lms.SendMessage(&m) == 0; tries++ {
+			if tries == 3 {
+				t.Fatalf("send message %d: %v", i, lms.Error())
+			}
+		}
+	}
+	if err = lms.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	lms.Close()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != n {
+		t.Fatalf("got %d stored messages, expected %d", len(stored), n)
+	}
+	for i, text := range stored {
+		if expected := fmt.Sprint("msg ", i+1); text != expected {
+			t.Fatalf("got stored message %q, expected %q", text, expected)
+		}
+	}
+}
@@ -2,60 +2,27 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"log"
 	"strings"
-	"time"
 
-	"github.com/chmike/go-dmon/dmon"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/pkg/errors"
 )
 
 var mysqlCredentials = "dmon:4dmonTest!@/dmon?charset=utf8"
 
-func database(msgs chan msgInfo) {
-	statStart(time.Duration(*periodFlag) * time.Second)
-
-	if *dbFlag == false {
-		for m := range msgs {
-			statUpdate(m.len)
-		}
-		return
-	}
-
-	db := NewMsgLogDB(mysqlCredentials, *dbBufLenFlag)
-	timer := time.NewTicker(time.Duration(*dbFlushFlag) * time.Millisecond)
-	gotMessagesSinceLaseTick := false
-	for {
-		select {
-		case <-timer.C:
-			// flush if we have one period without new messages
-			if gotMessagesSinceLaseTick == false && len(db.msgs) > 0 {
-				db.WriteMessages()
-			}
-			gotMessagesSinceLaseTick = false
-		case m := <-msgs:
-			gotMessagesSinceLaseTick = true
-			if len(db.msgs) == cap(db.msgs) {
-				db.WriteMessages()
-			}
-			db.msgs = append(db.msgs, m.msg)
-			statUpdate(m.len)
-		}
-	}
-}
-
 // MsgLogDB holds a connection to the database.
 type MsgLogDB struct {
 	cred string
 	db   *sql.DB
 	err  error
-	msgs []dmon.Msg
+	msgs []msgInfo
 }
 
 // NewMsgLogDB returns a new MsgLogDB.
 func NewMsgLogDB(cred string, bufLen int) *MsgLogDB {
-	return &MsgLogDB{cred: cred, msgs: make([]dmon.Msg, bufLen)}
+	return &MsgLogDB{cred: cred, msgs: make([]msgInfo, 0, bufLen)}
 }
 
 // Error return the last error.
@@ -63,35 +30,111 @@ func (db *MsgLogDB) Error() error {
 	return db.err
 }
 
-// WriteMessages write the logging messages in the database.
+// newMySQLSink returns a sink writing the messages in the MySQL database.
+func newMySQLSink(c *sinkConfig) (Sink, error) {
+	if c.DSN == "" {
+		return nil, errors.New("missing dsn")
+	}
+	return NewMsgLogDB(c.DSN, c.Batch), nil
+}
+
+// Write buffers the messages, and writes them in the database each time the
+// buffer is full.
+func (db *MsgLogDB) Write(ms []msgInfo) error {
+	var err error
+	for _, m := range ms {
+		if len(db.msgs) == cap(db.msgs) {
+			if db.WriteMessages(); db.err != nil {
+				err = db.err
+			}
+		}
+		db.msgs = append(db.msgs, m)
+	}
+	return err
+}
+
+// Flush writes the buffered messages in the database.
+func (db *MsgLogDB) Flush() error {
+	if len(db.msgs) == 0 {
+		return nil
+	}
+	db.WriteMessages()
+	return db.err
+}
+
+// Close writes the buffered messages and closes the database.
+func (db *MsgLogDB) Close() error {
+	err := db.Flush()
+	if db.db != nil {
+		db.db.Close()
+		db.db = nil
+	}
+	return err
+}
+
+// Health returns the error of the last write.
+func (db *MsgLogDB) Health() error {
+	return db.err
+}
+
+// WriteMessages write the logging messages in the database, and reports the
+// result to their producers. The messages are dropped on failure.
 func (db *MsgLogDB) WriteMessages() {
+	if len(db.msgs) == 0 {
+		return
+	}
 	if db.db == nil || db.err != nil {
 		db.tryOpenDatabase()
 	}
-	if db.Error() != nil {
-		log.Fatalf("database: %+v", errors.Wrap(db.Error(), "write messages"))
+	if db.err == nil {
+		db.insert()
 	}
-	if len(db.msgs) == 0 {
-		return
+	if db.err != nil {
+		statStorageError.add(uint64(len(db.msgs)))
+	}
+	for i := range db.msgs {
+		db.msgs[i].commit(db.err)
 	}
-	sqlStr := "INSERT INTO dmon(stamp, level, system, component, message) VALUES "
+	db.msgs = db.msgs[:0]
+}
+
+// insert inserts the messages in the database.
+func (db *MsgLogDB) insert() {
+	sqlStr := "INSERT INTO dmon(stamp, level, system, component, message, fields, pid, uid, gid, client_cn, client_san) VALUES "
 	vals := []interface{}{}
 	for _, m := range db.msgs {
-		sqlStr += "(?, ?, ?, ?, ?),"
-		vals = append(vals, m.Stamp, m.Level, m.System, m.Component, m.Message)
+		sqlStr += "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?),"
+		vals = append(vals, m.msg.Stamp, m.msg.Level, m.msg.System, m.msg.Component, m.msg.Message)
+		if len(m.msg.Fields) != 0 {
+			fields, _ := json.Marshal(m.msg.Fields)
+			vals = append(vals, string(fields))
+		} else {
+			vals = append(vals, nil)
+		}
+		if m.peer != nil {
+			vals = append(vals, m.peer.pid, m.peer.uid, m.peer.gid)
+		} else {
+			vals = append(vals, nil, nil, nil)
+		}
+		if m.client != nil {
+			vals = append(vals, m.client.cn, m.client.san())
+		} else {
+			vals = append(vals, nil, nil)
+		}
 	}
 	sqlStr = strings.TrimSuffix(sqlStr, ",")
-	stmt, _ := db.db.Prepare(sqlStr)
-	_, db.err = stmt.Exec(vals...)
+	var stmt *sql.Stmt
+	stmt, db.err = db.db.Prepare(sqlStr)
+	if db.err == nil {
+		_, db.err = stmt.Exec(vals...)
+		stmt.Close()
+	}
 	if db.err != nil {
 		db.err = errors.Wrap(db.err, "write to db")
 		log.Printf("%v", db.err)
 		db.db.Close()
 		db.db = nil
-		db.msgs = db.msgs[:0]
-		return
 	}
-	db.msgs = db.msgs[:0]
 }
 
 func (db *MsgLogDB) tryOpenDatabase() {
@@ -108,9 +151,18 @@ func (db *MsgLogDB) tryOpenDatabase() {
 			system VARCHAR(128) NOT NULL,
 			component VARCHAR(64) NOT NULL,
 			message VARCHAR(256) NOT NULL,
+			fields TEXT NULL,
+			pid INT NULL,
+			uid INT NULL,
+			gid INT NULL,
+			client_cn VARCHAR(64) NULL,
+			client_san TEXT NULL,
 			PRIMARY KEY (mid)
 		) ENGINE=INNODB
 	`)
+	if db.err == nil {
+		db.err = db.migrate()
+	}
 	if db.err != nil {
 		db.err = errors.Wrap(db.err, "open database")
 		db.db.Close()
@@ -118,3 +170,48 @@ func (db *MsgLogDB) tryOpenDatabase() {
 		return
 	}
 }
+
+// addedColumns are the columns added to the dmon table since its first
+// version, with their definition.
+var addedColumns = []struct{ name, def string }{
+	{"pid", "INT NULL"},
+	{"uid", "INT NULL"},
+	{"gid", "INT NULL"},
+	{"fields", "TEXT NULL"},
+	{"client_cn", "VARCHAR(64) NULL"},
+	{"client_san", "TEXT NULL"},
+}
+
+// migrate adds the missing added columns to a dmon table created by a
+// previous version.
+func (db *MsgLogDB) migrate() error {
+	rows, err := db.db.Query(`
+		SELECT COLUMN_NAME FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'dmon'
+	`)
+	if err != nil {
+		return errors.Wrap(err, "migrate")
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return errors.Wrap(err, "migrate")
+		}
+		columns[strings.ToLower(name)] = true
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "migrate")
+	}
+	for _, c := range addedColumns {
+		if columns[c.name] {
+			continue
+		}
+		if _, err = db.db.Exec("ALTER TABLE dmon ADD COLUMN " + c.name + " " + c.def); err != nil {
+			return errors.Wrapf(err, "migrate: add column %s", c.name)
+		}
+		log.Printf("database: added column %s to table dmon", c.name)
+	}
+	return nil
+}
@@ -8,11 +8,12 @@ import (
 
 // BufWriter is an io.Writer buffering output data.
 type BufWriter struct {
-	mtx sync.Mutex
-	buf []byte
-	n   int
-	w   io.Writer
-	err error
+	mtx    sync.Mutex
+	buf    []byte
+	n      int
+	w      io.Writer
+	err    error
+	closed bool
 }
 
 const minBufLen = 256
@@ -30,7 +31,7 @@ func NewBufWriter(w io.Writer, bufLen int, period time.Duration) *BufWriter {
 	delay := time.Duration(period)
 	go func() {
 		b.mtx.Lock()
-		for b.flush() == nil {
+		for !b.closed && b.flush() == nil {
 			b.mtx.Unlock()
 			time.Sleep(delay)
 			b.mtx.Lock()
@@ -46,6 +47,22 @@ func (b *BufWriter) Error() error {
 }
 
 // Flush writes the content of the buffer and return the error if any.
+func (b *BufWriter) Flush() error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.flush()
+}
+
+// Close flushes the buffer and stops the periodic flush. The underlying
+// writer is not closed.
+func (b *BufWriter) Close() error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.closed = true
+	return b.flush()
+}
+
+// flush writes the content of the buffer and return the error if any.
 // The mutex is required to be locked when called.
 func (b *BufWriter) flush() error {
 	if b.err == nil && b.n != 0 {
@@ -113,6 +130,12 @@ func (b *BufReader) Error() error {
 	return b.err
 }
 
+// Buffered returns the number of bytes that can be read without reading from
+// the underlying reader.
+func (b *BufReader) Buffered() int {
+	return b.end - b.beg
+}
+
 // Read bufferize the read operations.
 func (b *BufReader) fetch() error {
 	b.beg = 0
@@ -8,13 +8,14 @@ import (
 	"github.com/pkg/errors"
 )
 
-// Msg is a monitoring log meessage.
+// Msg is a monitoring log meessage. Fields holds optional structured data.
 type Msg struct {
-	Stamp     time.Time `json:"stamp"`
-	Level     string    `json:"level"`
-	System    string    `json:"system"`
-	Component string    `json:"component"`
-	Message   string    `json:"message"`
+	Stamp     time.Time         `json:"stamp"`
+	Level     string            `json:"level"`
+	System    string            `json:"system"`
+	Component string            `json:"component"`
+	Message   string            `json:"message"`
+	Fields    map[string]string `json:"fields,omitempty"`
 }
 
 // JSONEncode append json encoded message to buf.
@@ -28,10 +29,12 @@ func (m *Msg) JSONEncode(buf []byte) ([]byte, error) {
 
 // JSONDecode decode the json encoded message in front of data.
 func (m *Msg) JSONDecode(data []byte) error {
+	m.Fields = nil
 	return json.Unmarshal(data, m)
 }
 
-// BinaryEncode append binary encoded message to buf.
+// BinaryEncode append binary encoded message to buf. The fields, if any, are
+// appended after the message as their count followed by the keys and values.
 func (m *Msg) BinaryEncode(buf []byte) ([]byte, error) {
 	var b [8]byte
 	sub, err := m.Stamp.MarshalBinary()
@@ -52,35 +55,88 @@ func (m *Msg) BinaryEncode(buf []byte) ([]byte, error) {
 	binary.LittleEndian.PutUint32(b[:4], uint32(len(m.Message)))
 	buf = append(buf, b[:4]...)
 	buf = append(buf, []byte(m.Message)...)
+	if len(m.Fields) == 0 {
+		return buf, nil
+	}
+	binary.LittleEndian.PutUint32(b[:4], uint32(len(m.Fields)))
+	buf = append(buf, b[:4]...)
+	for k, v := range m.Fields {
+		binary.LittleEndian.PutUint32(b[:4], uint32(len(k)))
+		buf = append(buf, b[:4]...)
+		buf = append(buf, k...)
+		binary.LittleEndian.PutUint32(b[:4], uint32(len(v)))
+		buf = append(buf, b[:4]...)
+		buf = append(buf, v...)
+	}
 	return buf, nil
 }
 
 // BinaryDecode decode the binary encoded message in front of data.
 func (m *Msg) BinaryDecode(data []byte) error {
+	if len(data) == 0 || len(data) < 1+int(data[0]) {
+		return errors.Wrap(errShortData, "binary decode")
+	}
 	l := int(data[0])
 	data = data[1:]
 	if err := m.Stamp.UnmarshalBinary(data[:l]); err != nil {
 		return errors.Wrap(err, "binary decode")
 	}
 	data = data[l:]
-	l = int(binary.LittleEndian.Uint32(data[:4]))
-	data = data[4:]
-	m.Level = string(data[:l])
-	data = data[l:]
-	l = int(binary.LittleEndian.Uint32(data[:4]))
-	data = data[4:]
-	m.System = string(data[:l])
-	data = data[l:]
-	l = int(binary.LittleEndian.Uint32(data[:4]))
-	data = data[4:]
-	m.Component = string(data[:l])
-	data = data[l:]
-	l = int(binary.LittleEndian.Uint32(data[:4]))
+	var err error
+	if m.Level, data, err = decodeString(data); err != nil {
+		return errors.Wrap(err, "binary decode")
+	}
+	if m.System, data, err = decodeString(data); err != nil {
+		return errors.Wrap(err, "binary decode")
+	}
+	if m.Component, data, err = decodeString(data); err != nil {
+		return errors.Wrap(err, "binary decode")
+	}
+	if m.Message, data, err = decodeString(data); err != nil {
+		return errors.Wrap(err, "binary decode")
+	}
+	m.Fields = nil
+	if len(data) == 0 {
+		return nil
+	}
+	if len(data) < 4 {
+		return errors.Wrap(errShortData, "binary decode")
+	}
+	n := binary.LittleEndian.Uint32(data[:4])
 	data = data[4:]
-	if l != len(data) {
-		err := errors.Errorf("expected len(data)= %d, got %d", len(data), l)
+	if uint64(n) > uint64(len(data)/8) {
+		return errors.Wrap(errShortData, "binary decode")
+	}
+	m.Fields = make(map[string]string, n)
+	for i := uint32(0); i < n; i++ {
+		var k, v string
+		if k, data, err = decodeString(data); err != nil {
+			return errors.Wrap(err, "binary decode")
+		}
+		if v, data, err = decodeString(data); err != nil {
+			return errors.Wrap(err, "binary decode")
+		}
+		m.Fields[k] = v
+	}
+	if len(data) != 0 {
+		err := errors.Errorf("expected end of data, got %d more bytes", len(data))
 		return errors.Wrap(err, "binary decode")
 	}
-	m.Message = string(data)
 	return nil
 }
+
+var errShortData = errors.New("data too short")
+
+// decodeString decodes the length prefixed string in front of data and
+// returns it with the remaining data.
+func decodeString(data []byte) (string, []byte, error) {
+	if len(data) < 4 {
+		return "", data, errShortData
+	}
+	l := binary.LittleEndian.Uint32(data[:4])
+	data = data[4:]
+	if uint64(l) > uint64(len(data)) {
+		return "", data, errShortData
+	}
+	return string(data[:l]), data[l:], nil
+}
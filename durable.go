@@ -0,0 +1,245 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// In durable mode, set with -durable, a message is acknowledged only once it
+// is stored: committed to the database by the first mysql sink with "db",
+// or written and fsynced to the journal file with "journal". A message that could not be stored is
+// rejected with StatusStorageError, which the client may retry. HTTP
+// requests and Fluent Forward chunks are answered once all their messages
+// are stored. The messages received in datagrams or lines are not
+// acknowledged and are stored as usual.
+//
+// The database is written as soon as its sink buffer is empty, and the
+// journal groups the queued messages in one write and fsync. The journal is
+// only appended to, and may be rotated with copytruncate.
+//
+// To compare the throughput with the default mode, run the same client with
+// a window, e.g. "dmon -c -w 64", against "dmon -s -db" and
+// "dmon -s -db -durable db", or "dmon -s -durable journal", and compare the
+// message rates in the periodic stats of the server. BenchmarkDurable
+// compares the modes without the network.
+
+var statStorageError = newStatCounter("storage error")
+
+// maxUncommitted is the maximum number of messages of a connection waiting
+// to be stored in durable mode.
+const maxUncommitted = 1024
+
+// maxJournalBatch is the maximum number of messages written to the journal
+// with one fsync.
+const maxJournalBatch = 1024
+
+// newStored returns the channel receiving the storage result of n messages
+// in durable mode, or nil otherwise.
+func newStored(n int) chan error {
+	if *durableFlag == "" {
+		return nil
+	}
+	return make(chan error, n)
+}
+
+// waitStored waits for n storage results from stored and returns the first
+// error, preferring a storage error to errQueueTimeout. It returns nil
+// immediately when stored is nil.
+func waitStored(stored chan error, n int) error {
+	if stored == nil {
+		return nil
+	}
+	var err error
+	timeout := time.After(timeOutDelay)
+	for i := 0; i < n; i++ {
+		select {
+		case e := <-stored:
+			if e != nil && (err == nil || err == errQueueTimeout) {
+				err = e
+			}
+		case <-timeout:
+			return errors.New("storage timeout")
+		}
+	}
+	return err
+}
+
+// syncConn serializes the writes to a connection shared by goroutines.
+type syncConn struct {
+	net.Conn
+	mtx sync.Mutex
+}
+
+func (c *syncConn) Write(p []byte) (int, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.Conn.Write(p)
+}
+
+// committer acknowledges the messages of a connection once stored, in the
+// order they were received. Each message has its own result channel, so
+// that a message dropped or skipped before the earlier ones are stored is
+// acknowledged with its own sequence number.
+type committer struct {
+	conn     net.Conn
+	queue    chan ackRef
+	finished chan struct{}
+	once     sync.Once
+}
+
+// ackRef identifies a message waiting to be stored.
+type ackRef struct {
+	seq    uint64
+	legacy bool
+	stored chan error
+}
+
+// newCommitter returns a committer sending the acknowledgments on conn.
+func newCommitter(conn net.Conn) *committer {
+	c := &committer{
+		conn:     conn,
+		queue:    make(chan ackRef, maxUncommitted),
+		finished: make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// add registers the message with sequence number seq, or the legacy message,
+// and returns the channel to send its storage result to. It blocks while
+// maxUncommitted messages are waiting.
+func (c *committer) add(seq uint64, legacy bool) chan error {
+	stored := make(chan error, 1)
+	c.queue <- ackRef{seq: seq, legacy: legacy, stored: stored}
+	return stored
+}
+
+// close waits until all the added messages are acknowledged.
+func (c *committer) close() {
+	c.once.Do(func() {
+		close(c.queue)
+		<-c.finished
+	})
+}
+
+func (c *committer) run() {
+	defer close(c.finished)
+	var (
+		ackSeq uint64
+		nAck   int
+		err    error
+	)
+	for ref := range c.queue {
+		var e error
+		select {
+		case e = <-ref.stored:
+		default:
+			// send the pending acknowledgment before waiting
+			if nAck > 0 && err == nil {
+				err = sendFrame(c.conn, newAckFrame(ackSeq))
+				nAck = 0
+			}
+			e = <-ref.stored
+		}
+		if err != nil {
+			// connection failed, only wait for the results
+			continue
+		}
+		switch {
+		case e != nil && ref.legacy:
+			// no rejection in the legacy protocol, the client sends again
+			log.Printf("storage error: closing legacy connection from %s: %s", c.conn.RemoteAddr(), e)
+			err = e
+			c.conn.Close()
+			continue
+		case e != nil:
+			if nAck > 0 {
+				err = sendFrame(c.conn, newAckFrame(ackSeq))
+				nAck = 0
+			}
+			if err == nil {
+				reply := &ReplyError{Status: StatusStorageError, Seq: ref.seq, RetryAfter: retryDelay, Reason: e.Error()}
+				if e == errQueueTimeout {
+					reply.Status = StatusServerBusy
+				}
+				err = sendFrame(c.conn, newReplyFrame(reply))
+			}
+		case ref.legacy:
+			err = sendFrame(c.conn, []byte{ackCode})
+		default:
+			ackSeq = ref.seq
+			nAck++
+			if len(c.queue) == 0 || nAck >= maxAckBatch {
+				err = sendFrame(c.conn, newAckFrame(ackSeq))
+				nAck = 0
+			}
+		}
+		if err != nil {
+			log.Println("send acknowledgment error:", err)
+			c.conn.Close()
+		}
+	}
+}
+
+// journal appends the messages received from in to the file path and
+// passes them to out once fsynced. A message that could not be written is
+// passed on only when it will not be sent again. out is closed when in is.
+func journal(path string, in, out chan msgInfo) {
+	defer close(out)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		log.Fatalln("failed open journal:", err)
+	}
+	defer f.Close()
+	log.Println("journal:", path)
+
+	var (
+		batch []msgInfo
+		buf   []byte
+	)
+	for m := range in {
+		// group the queued messages
+		batch = append(batch[:0], m)
+	group:
+		for len(batch) < maxJournalBatch {
+			select {
+			case m, ok := <-in:
+				if !ok {
+					break group
+				}
+				batch = append(batch, m)
+			default:
+				break group
+			}
+		}
+
+		buf = buf[:0]
+		for i := range batch {
+			buf, _ = batch[i].msg.JSONEncode(buf)
+			buf = append(buf, '\n')
+		}
+		_, err = f.Write(buf)
+		if err == nil {
+			err = f.Sync()
+		}
+		if err != nil {
+			err = errors.Wrap(err, "write journal")
+			log.Println(err)
+			statStorageError.add(uint64(len(batch)))
+		}
+		for i := range batch {
+			acked := batch[i].stored != nil
+			batch[i].commit(err)
+			if err != nil && acked {
+				batch[i].done()
+				continue
+			}
+			out <- batch[i]
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chmike/go-dmon/dmon"
+)
+
+// BenchmarkDurable compares the throughput of the default mode with the db
+// and journal durable modes, from the message queue to the sink. The mysql
+// sink benchmarks are skipped when the database can't be opened, e.g.
+//
+//	go test -run NONE -bench Durable
+func BenchmarkDurable(b *testing.B) {
+	defer func(p int) { *periodFlag = p }(*periodFlag)
+	*periodFlag = 3600
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+	for _, bench := range []struct{ durable, sink string }{
+		{"", "stats"},
+		{"journal", "stats"},
+		{"", "mysql"},
+		{"db", "mysql"},
+		{"journal", "mysql"},
+	} {
+		name := bench.durable
+		if name == "" {
+			name = "default"
+		}
+		b.Run(name+"/"+bench.sink, func(b *testing.B) {
+			benchDurable(b, bench.durable, bench.sink)
+		})
+	}
+}
+
+// benchDurable passes b.N messages to a sink of type sink in the durable
+// mode, and waits until they are all acknowledged, or written in the
+// default mode.
+func benchDurable(b *testing.B, durable, sink string) {
+	defer func(d string) { *durableFlag = d }(*durableFlag)
+	*durableFlag = durable
+	if sink == "mysql" {
+		db := NewMsgLogDB(mysqlCredentials, 1)
+		if db.tryOpenDatabase(); db.err != nil {
+			b.Skip(db.err)
+		}
+		db.Close()
+	}
+	rs, err := newSinks(&config{Sinks: []sinkConfig{{Type: sink, DSN: mysqlCredentials, Block: true}}})
+	if err != nil {
+		b.Fatal(err)
+	}
+	msgs := make(chan msgInfo, *dbBufLenFlag*10)
+	sinkMsgs := msgs
+	if durable == "journal" {
+		sinkMsgs = make(chan msgInfo, cap(msgs))
+		go journal(filepath.Join(b.TempDir(), "journal"), msgs, sinkMsgs)
+	}
+	done := make(chan error, 1)
+	go func() { done <- fanOut(sinkMsgs, rs, nil) }()
+
+	// read the acknowledgments as a client with an unlimited window
+	var c *committer
+	acked := make(chan struct{})
+	if durable == "" {
+		close(acked)
+	} else {
+		srv, cli := net.Pipe()
+		defer cli.Close()
+		c = newCommitter(srv)
+		go func() {
+			defer close(acked)
+			r := dmon.NewBufReader(cli, 4096)
+			for {
+				a := readAck(r)
+				if a.err != nil || a.reply != nil {
+					b.Errorf("got reply %v, error %v", a.reply, a.err)
+					cli.Close()
+					return
+				}
+				if a.seq == uint64(b.N) {
+					return
+				}
+			}
+		}()
+	}
+
+	m := msgInfo{msg: dmon.Msg{Stamp: time.Now(), Level: "info", System: "bench",
+		Component: "durable", Message: "benchmark message"}}
+	m.len = hdrLen + len(m.msg.Message)
+	b.ResetTimer()
+	for seq := 1; seq <= b.N; seq++ {
+		if c != nil {
+			m.stored = c.add(uint64(seq), false)
+		}
+		msgs <- m
+	}
+	<-acked
+	if c != nil {
+		c.close()
+	}
+	close(msgs)
+	if err = <-done; err != nil {
+		b.Fatal(err)
+	}
+}
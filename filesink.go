@@ -0,0 +1,335 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/chmike/go-dmon/dmon"
+	"github.com/pkg/errors"
+)
+
+// The file sink writes the messages in the file path, one per line, in
+// NDJSON or in logfmt text readable by the line listener. The file is
+// rotated when it would exceed max_size bytes, and at each rotate period
+// (e.g. "1h", "24h"), aligned on UTC. A rotated file is renamed with the
+// rotation time as suffix, and gzipped in the background when compress is
+// set. Only the max_files last rotated files are kept, and those older
+// than max_days are removed. SIGHUP reopens the file, e.g. after an external
+// logrotate.
+//
+// When a write fails, e.g. because the disk is full, the messages of the
+// batch are lost, the file is closed and it is reopened after
+// fileRetryDelay.
+
+const (
+	fileBufLen     = 64 * 1024
+	fileRetryDelay = 5 * time.Second
+	fileStampFmt   = "20060102-150405"
+)
+
+// fileSink writes the messages in a rotated file.
+type fileSink struct {
+	conf   *sinkConfig
+	text   bool
+	period time.Duration
+	f      *os.File
+	w      *dmon.BufWriter
+	size   int64
+	next   time.Time // time of the next rotation
+	retry  time.Time // time of the next open after a failure
+	err    error
+	buf    []byte
+	reopen int32 // set by SIGHUP
+	hup    chan os.Signal
+	jobs   chan string // rotated files to compress and prune
+	wg     sync.WaitGroup
+}
+
+func newFileSink(c *sinkConfig) (Sink, error) {
+	if c.Path == "" {
+		return nil, errors.New("missing path")
+	}
+	s := &fileSink{conf: c, jobs: make(chan string, 16)}
+	switch c.Format {
+	case "", "ndjson":
+	case "text":
+		s.text = true
+	default:
+		return nil, errors.Errorf("invalid format '%s'", c.Format)
+	}
+	if c.Rotate != "" {
+		var err error
+		if s.period, err = time.ParseDuration(c.Rotate); err != nil || s.period <= 0 {
+			return nil, errors.Errorf("invalid rotate period '%s'", c.Rotate)
+		}
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	s.hup = make(chan os.Signal, 1)
+	signal.Notify(s.hup, syscall.SIGHUP)
+	go func() {
+		for range s.hup {
+			atomic.StoreInt32(&s.reopen, 1)
+		}
+	}()
+	s.wg.Add(1)
+	go s.archive()
+	return s, nil
+}
+
+// open opens the file in append mode.
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.conf.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return errors.Wrap(err, "open file")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "open file")
+	}
+	s.f, s.size = f, info.Size()
+	s.w = dmon.NewBufWriter(f, fileBufLen, time.Duration(s.conf.Linger)*time.Millisecond)
+	if s.period > 0 {
+		s.next = time.Now().Truncate(s.period).Add(s.period)
+	}
+	return nil
+}
+
+// close flushes and closes the file.
+func (s *fileSink) close() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.w.Close()
+	if err2 := s.f.Close(); err == nil {
+		err = err2
+	}
+	s.f, s.w = nil, nil
+	return errors.Wrap(err, "close file")
+}
+
+// fail closes the file after the error err, and delays its reopening.
+func (s *fileSink) fail(err error) error {
+	s.close()
+	s.err = err
+	s.retry = time.Now().Add(fileRetryDelay)
+	return err
+}
+
+// rotate renames the file with the current time as suffix, queues it for
+// archiving and opens a new file.
+func (s *fileSink) rotate() error {
+	if err := s.close(); err != nil {
+		return err
+	}
+	name := s.conf.Path + "." + time.Now().UTC().Format(fileStampFmt)
+	if _, err := os.Stat(name); err == nil {
+		name += "-" + strconv.FormatInt(time.Now().UnixNano()%1e9, 10)
+	}
+	if err := os.Rename(s.conf.Path, name); err != nil {
+		return errors.Wrap(err, "rotate file")
+	}
+	select {
+	case s.jobs <- name:
+	default:
+		log.Printf("sink %s: archive queue full, %s left as is", s.conf.Name, name)
+	}
+	return s.open()
+}
+
+// prepare reopens or rotates the file when needed before writing n bytes.
+func (s *fileSink) prepare(n int) error {
+	if atomic.SwapInt32(&s.reopen, 0) == 1 {
+		if err := s.close(); err != nil {
+			return err
+		}
+	}
+	if s.f == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.size > 0 && ((s.conf.MaxSize > 0 && s.size+int64(n) > s.conf.MaxSize) ||
+		(s.period > 0 && !time.Now().Before(s.next))) {
+		return s.rotate()
+	}
+	return nil
+}
+
+func (s *fileSink) Write(ms []msgInfo) error {
+	s.buf = s.buf[:0]
+	for i := range ms {
+		if s.text {
+			s.buf = appendLogfmt(s.buf, &ms[i].msg)
+			continue
+		}
+		data, err := json.Marshal(&ms[i].msg)
+		if err != nil {
+			return errors.Wrap(err, "encode message")
+		}
+		s.buf = append(append(s.buf, data...), '\n')
+	}
+	err := s.err
+	if s.f != nil || !time.Now().Before(s.retry) {
+		if err = s.prepare(len(s.buf)); err == nil {
+			_, err = s.w.Write(s.buf)
+		}
+		if err != nil {
+			err = s.fail(errors.Wrap(err, "write file"))
+		} else {
+			s.size += int64(len(s.buf))
+			s.err = nil
+		}
+	}
+	for i := range ms {
+		ms[i].commit(err)
+	}
+	return err
+}
+
+func (s *fileSink) Flush() error {
+	if s.f == nil {
+		return nil
+	}
+	if err := s.w.Flush(); err != nil {
+		return s.fail(errors.Wrap(err, "flush file"))
+	}
+	return nil
+}
+
+func (s *fileSink) Close() error {
+	signal.Stop(s.hup)
+	close(s.hup)
+	err := s.close()
+	close(s.jobs)
+	s.wg.Wait()
+	return err
+}
+
+func (s *fileSink) Health() error {
+	return s.err
+}
+
+// archive compresses the rotated files and prunes the old ones.
+func (s *fileSink) archive() {
+	defer s.wg.Done()
+	for name := range s.jobs {
+		if s.conf.Compress {
+			if err := gzipFile(name); err != nil {
+				log.Printf("sink %s: %v", s.conf.Name, err)
+			}
+		}
+		if err := s.prune(); err != nil {
+			log.Printf("sink %s: %v", s.conf.Name, err)
+		}
+	}
+}
+
+// prune removes the rotated files beyond max_files or older than max_days.
+func (s *fileSink) prune() error {
+	if s.conf.MaxFiles <= 0 && s.conf.MaxDays <= 0 {
+		return nil
+	}
+	names, err := filepath.Glob(s.conf.Path + ".[0-9]*")
+	if err != nil {
+		return errors.Wrap(err, "prune files")
+	}
+	var rotated []string
+	for _, name := range names {
+		if !strings.HasSuffix(name, ".tmp") {
+			rotated = append(rotated, name)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(rotated)))
+	limit := time.Now().AddDate(0, 0, -s.conf.MaxDays)
+	for i, name := range rotated {
+		if s.conf.MaxFiles > 0 && i >= s.conf.MaxFiles {
+			os.Remove(name)
+			continue
+		}
+		if info, err := os.Stat(name); err == nil && s.conf.MaxDays > 0 && info.ModTime().Before(limit) {
+			os.Remove(name)
+		}
+	}
+	return nil
+}
+
+// gzipFile replaces the file name with its gzipped copy name.gz.
+func gzipFile(name string) (err error) {
+	in, err := os.Open(name)
+	if err != nil {
+		return errors.Wrap(err, "compress file")
+	}
+	defer in.Close()
+	tmp := name + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return errors.Wrap(err, "compress file")
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}()
+	zw := gzip.NewWriter(out)
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp, name+".gz")
+	}
+	if err != nil {
+		return errors.Wrapf(err, "compress file %s", name)
+	}
+	return errors.Wrap(os.Remove(name), "compress file")
+}
+
+// appendLogfmt appends the message m as a logfmt line to buf.
+func appendLogfmt(buf []byte, m *dmon.Msg) []byte {
+	buf = append(buf, "time="...)
+	buf = m.Stamp.UTC().AppendFormat(buf, time.RFC3339Nano)
+	buf = appendLogfmtPair(buf, "level", m.Level)
+	buf = appendLogfmtPair(buf, "system", m.System)
+	buf = appendLogfmtPair(buf, "component", m.Component)
+	buf = appendLogfmtPair(buf, "msg", m.Message)
+	keys := make([]string, 0, len(m.Fields))
+	for k := range m.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		buf = appendLogfmtPair(buf, k, m.Fields[k])
+	}
+	return append(buf, '\n')
+}
+
+// appendLogfmtPair appends " key=value" to buf, with value quoted if needed.
+func appendLogfmtPair(buf []byte, key, value string) []byte {
+	buf = append(append(append(buf, ' '), key...), '=')
+	if value == "" || strings.IndexFunc(value, func(r rune) bool {
+		return r <= ' ' || r == '=' || r == '"' || r == '\\' || r >= 0x7f
+	}) >= 0 {
+		return strconv.AppendQuote(buf, value)
+	}
+	return append(buf, value...)
+}
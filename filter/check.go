@@ -0,0 +1,202 @@
+package filter
+
+import (
+	"regexp"
+	"strings"
+)
+
+// levels are the message levels in increasing severity.
+var levels = []string{"debug", "info", "warn", "error", "fatal"}
+
+// levelRank returns the index of level in levels, or -1 if it is not a valid
+// level.
+func levelRank(level string) int {
+	for i, l := range levels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+// attributes are the types of the message fields.
+var attributes = map[string]typ{
+	"level":     tyLevel,
+	"system":    tyString,
+	"component": tyString,
+	"message":   tyString,
+}
+
+// functions are the argument and result types of the functions, except has.
+var functions = map[string]struct {
+	arg, result typ
+}{
+	"len":   {tyString, tyNumber},
+	"lower": {tyString, tyString},
+	"num":   {tyString, tyNumber},
+}
+
+// checker sets the types of the nodes of a syntax tree.
+type checker struct {
+	src string
+}
+
+// check type checks the boolean expression n of source src.
+func check(src string, n node) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			if err, _ = e.(*Error); err == nil {
+				panic(e)
+			}
+		}
+	}()
+	c := &checker{src: src}
+	if t := c.check(n); t != tyBool {
+		c.errorf(n, "expression is %s, must be bool", t)
+	}
+	return nil
+}
+
+func (c *checker) errorf(n node, format string, args ...interface{}) {
+	panic(errorAt(c.src, n.pos(), format, args...))
+}
+
+// check returns the type of node n.
+func (c *checker) check(n node) typ {
+	switch n := n.(type) {
+	case *nameNode:
+		if t, ok := attributes[n.name]; ok {
+			n.t = t
+		} else if n.rank = levelRank(n.name); n.rank >= 0 {
+			n.t = tyLevel
+		} else if n.name == "true" || n.name == "false" {
+			n.t = tyBool
+		} else {
+			c.errorf(n, "unknown name '%s'", n.name)
+		}
+	case *fieldNode:
+		n.t = tyString
+	case *strNode:
+		n.t = tyString
+	case *numNode:
+		n.t = tyNumber
+	case *unaryNode:
+		want := tyBool
+		if n.op == tMinus {
+			want = tyNumber
+		}
+		if t := c.check(n.x); t != want {
+			c.errorf(n, "operator %s requires %s, got %s", opText(n.op), want, t)
+		}
+		n.t = want
+	case *binaryNode:
+		c.binary(n)
+	case *inNode:
+		tx := c.check(n.x)
+		for _, y := range n.list {
+			ty := c.check(y)
+			if tx == tyLevel && ty == tyString {
+				ty = c.level(y)
+			}
+			if tx != ty {
+				c.errorf(y, "mismatched types %s and %s in in", tx, ty)
+			}
+		}
+		n.t = tyBool
+	case *callNode:
+		c.call(n)
+	}
+	return n.typ()
+}
+
+func (c *checker) binary(n *binaryNode) {
+	n.t = tyBool
+	switch n.op.kind {
+	case tAnd, tOr:
+		for _, x := range []node{n.x, n.y} {
+			if t := c.check(x); t != tyBool {
+				c.errorf(x, "operand of %s must be bool, got %s", n.op.text, t)
+			}
+		}
+	case tMatch, tNotMatch:
+		if t := c.check(n.x); t != tyString {
+			c.errorf(n.x, "operand of %s must be string, got %s", n.op.text, t)
+		}
+		s, ok := n.y.(*strNode)
+		if !ok {
+			c.errorf(n.y, "operand of %s must be a constant string", n.op.text)
+		}
+		s.t = tyString
+		var err error
+		if n.regex, err = regexp.Compile(s.val); err != nil {
+			msg := strings.TrimPrefix(err.Error(), "error parsing regexp: ")
+			c.errorf(s, "invalid regular expression: %s", msg)
+		}
+	default:
+		t := c.compare(n.x, n.y, n.op.text)
+		if t == tyBool && n.op.kind != tEq && n.op.kind != tNe {
+			c.errorf(n, "operator %s not defined on bool", n.op.text)
+		}
+	}
+}
+
+// compare checks that x and y may be compared by operator op, and returns
+// their type. A string constant compared with a level becomes a level.
+func (c *checker) compare(x, y node, op string) typ {
+	tx, ty := c.check(x), c.check(y)
+	if tx == tyLevel && ty == tyString {
+		ty = c.level(y)
+	} else if tx == tyString && ty == tyLevel {
+		tx = c.level(x)
+	}
+	if tx != ty {
+		c.errorf(y, "mismatched types %s and %s in %s", tx, ty, op)
+	}
+	return tx
+}
+
+// level converts the string constant n to a level.
+func (c *checker) level(n node) typ {
+	s, ok := n.(*strNode)
+	if !ok {
+		return tyString
+	}
+	if s.rank = levelRank(s.val); s.rank < 0 {
+		c.errorf(n, "unknown level %q, expected one of %s", s.val, strings.Join(levels, ", "))
+	}
+	s.t = tyLevel
+	return tyLevel
+}
+
+func (c *checker) call(n *callNode) {
+	if n.name == "has" {
+		if len(n.args) != 1 {
+			c.errorf(n, "has requires 1 argument, got %d", len(n.args))
+		}
+		if _, ok := n.args[0].(*fieldNode); !ok {
+			c.errorf(n.args[0], "argument of has must be a structured field")
+		}
+		n.t = tyBool
+		return
+	}
+	f, ok := functions[n.name]
+	if !ok {
+		c.errorf(n, "unknown function '%s'", n.name)
+	}
+	if len(n.args) != 1 {
+		c.errorf(n, "%s requires 1 argument, got %d", n.name, len(n.args))
+	}
+	if t := c.check(n.args[0]); t != f.arg {
+		c.errorf(n.args[0], "argument of %s must be %s, got %s", n.name, f.arg, t)
+	}
+	n.t = f.result
+}
+
+func opText(k tokKind) string {
+	for _, op := range operators {
+		if op.kind == k {
+			return op.text
+		}
+	}
+	return "?"
+}
@@ -0,0 +1,180 @@
+package filter
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/chmike/go-dmon/dmon"
+)
+
+// The type checked syntax tree is compiled into closures evaluating each
+// node with the Go type of its filter type.
+
+func compileBool(n node) func(m *dmon.Msg) bool {
+	switch n := n.(type) {
+	case *nameNode:
+		v := n.name == "true"
+		return func(*dmon.Msg) bool { return v }
+	case *unaryNode:
+		x := compileBool(n.x)
+		return func(m *dmon.Msg) bool { return !x(m) }
+	case *binaryNode:
+		return compileBinary(n)
+	case *inNode:
+		eqs := make([]func(*dmon.Msg) bool, len(n.list))
+		for i, y := range n.list {
+			eqs[i] = compileCompare(tEq, n.x, y)
+		}
+		return func(m *dmon.Msg) bool {
+			for _, eq := range eqs {
+				if eq(m) {
+					return true
+				}
+			}
+			return false
+		}
+	case *callNode: // has
+		key := n.args[0].(*fieldNode).key
+		return func(m *dmon.Msg) bool {
+			_, ok := m.Fields[key]
+			return ok
+		}
+	}
+	panic("filter: invalid bool node")
+}
+
+func compileBinary(n *binaryNode) func(m *dmon.Msg) bool {
+	switch n.op.kind {
+	case tAnd:
+		x, y := compileBool(n.x), compileBool(n.y)
+		return func(m *dmon.Msg) bool { return x(m) && y(m) }
+	case tOr:
+		x, y := compileBool(n.x), compileBool(n.y)
+		return func(m *dmon.Msg) bool { return x(m) || y(m) }
+	case tMatch:
+		x, re := compileString(n.x), n.regex
+		return func(m *dmon.Msg) bool { return re.MatchString(x(m)) }
+	case tNotMatch:
+		x, re := compileString(n.x), n.regex
+		return func(m *dmon.Msg) bool { return !re.MatchString(x(m)) }
+	}
+	return compileCompare(n.op.kind, n.x, n.y)
+}
+
+// compileCompare compiles the comparison of x and y by operator op.
+func compileCompare(op tokKind, x, y node) func(m *dmon.Msg) bool {
+	// cmp returns the comparison of x and y, and false if they are unordered
+	var cmp func(m *dmon.Msg) (int, bool)
+	switch x.typ() {
+	case tyString:
+		fx, fy := compileString(x), compileString(y)
+		cmp = func(m *dmon.Msg) (int, bool) { return strings.Compare(fx(m), fy(m)), true }
+	case tyNumber:
+		fx, fy := compileNumber(x), compileNumber(y)
+		cmp = func(m *dmon.Msg) (int, bool) {
+			a, b := fx(m), fy(m)
+			switch {
+			case a < b:
+				return -1, true
+			case a > b:
+				return 1, true
+			}
+			return 0, a == b
+		}
+	case tyLevel:
+		fx, fy := compileLevel(x), compileLevel(y)
+		cmp = func(m *dmon.Msg) (int, bool) {
+			a, b := fx(m), fy(m)
+			return a - b, a >= 0 && b >= 0
+		}
+	case tyBool:
+		fx, fy := compileBool(x), compileBool(y)
+		cmp = func(m *dmon.Msg) (int, bool) {
+			if fx(m) == fy(m) {
+				return 0, true
+			}
+			return 1, true
+		}
+	}
+	switch op {
+	case tEq:
+		return func(m *dmon.Msg) bool { c, ok := cmp(m); return ok && c == 0 }
+	case tNe:
+		return func(m *dmon.Msg) bool { c, ok := cmp(m); return !ok || c != 0 }
+	case tLt:
+		return func(m *dmon.Msg) bool { c, ok := cmp(m); return ok && c < 0 }
+	case tLe:
+		return func(m *dmon.Msg) bool { c, ok := cmp(m); return ok && c <= 0 }
+	case tGt:
+		return func(m *dmon.Msg) bool { c, ok := cmp(m); return ok && c > 0 }
+	case tGe:
+		return func(m *dmon.Msg) bool { c, ok := cmp(m); return ok && c >= 0 }
+	}
+	panic("filter: invalid comparison")
+}
+
+func compileString(n node) func(m *dmon.Msg) string {
+	switch n := n.(type) {
+	case *nameNode:
+		switch n.name {
+		case "system":
+			return func(m *dmon.Msg) string { return m.System }
+		case "component":
+			return func(m *dmon.Msg) string { return m.Component }
+		case "message":
+			return func(m *dmon.Msg) string { return m.Message }
+		}
+	case *fieldNode:
+		key := n.key
+		return func(m *dmon.Msg) string { return m.Fields[key] }
+	case *strNode:
+		v := n.val
+		return func(*dmon.Msg) string { return v }
+	case *callNode: // lower
+		x := compileString(n.args[0])
+		return func(m *dmon.Msg) string { return strings.ToLower(x(m)) }
+	}
+	panic("filter: invalid string node")
+}
+
+func compileNumber(n node) func(m *dmon.Msg) float64 {
+	switch n := n.(type) {
+	case *numNode:
+		v := n.val
+		return func(*dmon.Msg) float64 { return v }
+	case *unaryNode:
+		x := compileNumber(n.x)
+		return func(m *dmon.Msg) float64 { return -x(m) }
+	case *callNode:
+		x := compileString(n.args[0])
+		if n.name == "len" {
+			return func(m *dmon.Msg) float64 { return float64(len(x(m))) }
+		}
+		return func(m *dmon.Msg) float64 {
+			v, err := strconv.ParseFloat(strings.TrimSpace(x(m)), 64)
+			if err != nil {
+				return math.NaN()
+			}
+			return v
+		}
+	}
+	panic("filter: invalid number node")
+}
+
+// compileLevel returns the level rank of n, or -1 if it is not a valid
+// level.
+func compileLevel(n node) func(m *dmon.Msg) int {
+	switch n := n.(type) {
+	case *nameNode:
+		if n.name == "level" {
+			return func(m *dmon.Msg) int { return levelRank(m.Level) }
+		}
+		v := n.rank
+		return func(*dmon.Msg) int { return v }
+	case *strNode:
+		v := n.rank
+		return func(*dmon.Msg) int { return v }
+	}
+	panic("filter: invalid level node")
+}
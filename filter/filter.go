@@ -0,0 +1,106 @@
+// Package filter implements a small expression language selecting dmon
+// messages, e.g.
+//
+//	level >= warn && system == "billing" && message ~ "timeout"
+//
+// The names level, system, component and message are the fields of the
+// message, and fields.key or fields["key"] are the values of its structured
+// fields, which are empty when missing. The levels debug, info, warn, error
+// and fatal are ordered by severity, and a level may also be written as a
+// string, e.g. level == "warn".
+//
+// The operators are, by increasing precedence,
+//
+//	||
+//	&&
+//	== != < <= > >= ~ !~ in
+//	! - (unary)
+//
+// where ~ and !~ match a string with a constant regular expression, and
+// x in (a, b, ...) is true when x is equal to one of the values. Unary
+// operators bind tighter than comparisons, so that a negated comparison is
+// written !(x == y). Strings are double quoted with Go escapes, or back
+// quoted without escapes. Numbers are decimal floating point numbers.
+//
+// The functions are
+//
+//	has(fields.key)  true if the message has the structured field key
+//	len(s)           the number of bytes of string s
+//	lower(s)         string s in lower case
+//	num(s)           the number in string s, or NaN if invalid
+//
+// A comparison with a NaN number is false, except != which is true. An
+// expression is type checked when compiled, and must be a boolean.
+package filter
+
+import (
+	"fmt"
+
+	"github.com/chmike/go-dmon/dmon"
+)
+
+// Filter is a compiled filter expression.
+type Filter struct {
+	src   string
+	expr  node
+	match func(m *dmon.Msg) bool
+}
+
+// Compile returns the filter of the expression src, or an *Error locating
+// its first syntax or type error.
+func Compile(src string) (*Filter, error) {
+	n, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+	if err = check(src, n); err != nil {
+		return nil, err
+	}
+	return &Filter{src: src, expr: n, match: compileBool(n)}, nil
+}
+
+// MustCompile is like Compile but panics if the expression is invalid.
+func MustCompile(src string) *Filter {
+	f, err := Compile(src)
+	if err != nil {
+		panic(fmt.Sprintf("filter: compile %q: %v", src, err))
+	}
+	return f
+}
+
+// Match returns true if message m is selected by the filter.
+func (f *Filter) Match(m *dmon.Msg) bool {
+	return f.match(m)
+}
+
+// String returns the source of the filter.
+func (f *Filter) String() string {
+	return f.src
+}
+
+// Error is a syntax or type error in a filter expression.
+type Error struct {
+	Line, Col int // position of the error starting at 1, Col in runes
+	Msg       string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Col, e.Msg)
+}
+
+// errorAt returns the error at byte offset pos of src.
+func errorAt(src string, pos int, format string, args ...interface{}) *Error {
+	e := &Error{Line: 1, Col: 1, Msg: fmt.Sprintf(format, args...)}
+	if pos > len(src) {
+		pos = len(src)
+	}
+	for _, r := range src[:pos] {
+		if r == '\n' {
+			e.Line++
+			e.Col = 1
+		} else {
+			e.Col++
+		}
+	}
+	return e
+}
@@ -0,0 +1,133 @@
+package filter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chmike/go-dmon/dmon"
+)
+
+var testMsgs = []dmon.Msg{
+	{},
+	{
+		Stamp:     time.Unix(0, 0),
+		Level:     "warn",
+		System:    "billing",
+		Component: "api",
+		Message:   "request timeout",
+		Fields:    map[string]string{"latency": "12.5", "user": "bob"},
+	},
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		src       string
+		line, col int
+		msg       string
+	}{
+		{"", 1, 1, "expected operand, found end of expression"},
+		{"level", 1, 1, "expression is level, must be bool"},
+		{"level >=", 1, 9, "expected operand, found end of expression"},
+		{"level >= bogus", 1, 10, "unknown name 'bogus'"},
+		{"system == 1", 1, 11, "mismatched types string and number in =="},
+		{"(level == warn", 1, 15, "expected ')', found end of expression"},
+		{"level == warn)", 1, 14, "unexpected ')'"},
+		{`system == "a" == "b"`, 1, 15, "unexpected '==', comparisons cannot be chained"},
+		{"fields.", 1, 8, "expected field name after 'fields.', found end of expression"},
+		{"fields[1]", 1, 8, "expected field name string after 'fields[', found number 1"},
+		{`message ~ "("`, 1, 11, "invalid regular expression: missing closing ): `(`"},
+		{"message ~ system", 1, 11, "operand of ~ must be a constant string"},
+		{"len(1)", 1, 5, "argument of len must be string, got number"},
+		{"nope(system)", 1, 1, "unknown function 'nope'"},
+		{"lower()", 1, 1, "lower requires 1 argument, got 0"},
+		{"has(system)", 1, 5, "argument of has must be a structured field"},
+		{"-system", 1, 1, "operator - requires number, got string"},
+		{"!level", 1, 1, "operator ! requires bool, got level"},
+		{"system == \"a\" &&\n  componen == \"b\"", 2, 3, "unknown name 'componen'"},
+		{`"é" == 1`, 1, 8, "mismatched types string and number in =="},
+		{`system == "unterminated`, 1, 11, "unterminated string"},
+		{"1 @ 2", 1, 3, "unexpected character '@'"},
+		{"num(fields.x) > 1 || level", 1, 22, "operand of || must be bool, got level"},
+	}
+	for _, test := range tests {
+		_, err := Compile(test.src)
+		e, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%q: got error %v, expected an *Error", test.src, err)
+			continue
+		}
+		if e.Line != test.line || e.Col != test.col || e.Msg != test.msg {
+			t.Errorf("%q: got %v, expected %d:%d: %s", test.src, e, test.line, test.col, test.msg)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		src   string
+		match [2]bool // results for testMsgs
+	}{
+		{"true", [2]bool{true, true}},
+		{`level >= warn && system == "billing" && message ~ "timeout"`, [2]bool{false, true}},
+		{`level == "warn"`, [2]bool{false, true}},
+		{`component in ("db", "api")`, [2]bool{false, true}},
+		{`has(fields.user) && fields["user"] == "bob"`, [2]bool{false, true}},
+		{"num(fields.latency) > 10", [2]bool{false, true}},
+		{"num(fields.latency) != 10", [2]bool{true, true}},
+		{`!(lower(system) !~ "^bill") || len(message) == 0`, [2]bool{true, true}},
+	}
+	for _, test := range tests {
+		f, err := Compile(test.src)
+		if err != nil {
+			t.Errorf("%q: %v", test.src, err)
+			continue
+		}
+		for i := range testMsgs {
+			if got := f.Match(&testMsgs[i]); got != test.match[i] {
+				t.Errorf("%q: message %d: got %v, expected %v", test.src, i, got, test.match[i])
+			}
+		}
+	}
+}
+
+// FuzzCompile checks that the parser, the checker and the compiled filters
+// do not panic, and that the formatted syntax tree of a valid expression
+// compiles to the same syntax tree.
+func FuzzCompile(f *testing.F) {
+	for _, src := range []string{
+		`level >= warn && system == "billing" && message ~ "timeout"`,
+		`component in ("db", "api") || !(level == debug)`,
+		`has(fields.user) && fields["user id"] != ""`,
+		"num(fields.latency) > -1.5e3 && len(lower(message)) < 10",
+		"message !~ `^a.*b$`",
+		"((true))",
+		"level >=",
+	} {
+		f.Add(src)
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		flt, err := Compile(src)
+		if err != nil {
+			if _, ok := err.(*Error); !ok {
+				t.Fatalf("%q: error %v is not an *Error", src, err)
+			}
+			return
+		}
+		for i := range testMsgs {
+			flt.Match(&testMsgs[i])
+		}
+		formatted := format(flt.expr)
+		g, err := Compile(formatted)
+		if err != nil {
+			t.Fatalf("%q: formatted expression %q: %v", src, formatted, err)
+		}
+		if format(g.expr) != formatted {
+			t.Fatalf("%q: formatted expression %q changed to %q", src, formatted, format(g.expr))
+		}
+		for i := range testMsgs {
+			if flt.Match(&testMsgs[i]) != g.Match(&testMsgs[i]) {
+				t.Fatalf("%q: formatted expression %q has another result", src, formatted)
+			}
+		}
+	})
+}
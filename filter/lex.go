@@ -0,0 +1,173 @@
+package filter
+
+import (
+	"strconv"
+	"strings"
+)
+
+// tokKind is the kind of a token.
+type tokKind int
+
+const (
+	tEOF tokKind = iota
+	tIdent
+	tString
+	tNumber
+	tIn
+	tOr       // ||
+	tAnd      // &&
+	tNot      // !
+	tMinus    // -
+	tEq       // ==
+	tNe       // !=
+	tLt       // <
+	tLe       // <=
+	tGt       // >
+	tGe       // >=
+	tMatch    // ~
+	tNotMatch // !~
+	tLParen   // (
+	tRParen   // )
+	tLBrack   // [
+	tRBrack   // ]
+	tComma    // ,
+	tDot      // .
+)
+
+// operators are the operator tokens, longest first.
+var operators = []struct {
+	text string
+	kind tokKind
+}{
+	{"||", tOr}, {"&&", tAnd}, {"==", tEq}, {"!=", tNe}, {"!~", tNotMatch},
+	{"<=", tLe}, {">=", tGe}, {"<", tLt}, {">", tGt}, {"~", tMatch},
+	{"!", tNot}, {"-", tMinus}, {"(", tLParen}, {")", tRParen},
+	{"[", tLBrack}, {"]", tRBrack}, {",", tComma}, {".", tDot},
+}
+
+// token is a lexical token at byte offset pos of the source.
+type token struct {
+	kind tokKind
+	pos  int
+	text string // source text
+	val  string // value of a string
+	num  float64
+}
+
+// String returns the description of the token in error messages.
+func (t token) String() string {
+	switch t.kind {
+	case tEOF:
+		return "end of expression"
+	case tIdent:
+		return "name '" + t.text + "'"
+	case tString:
+		return "string " + t.text
+	case tNumber:
+		return "number " + t.text
+	}
+	return "'" + t.text + "'"
+}
+
+// lexer splits a filter expression into tokens.
+type lexer struct {
+	src string
+	pos int
+}
+
+// next returns the next token.
+func (l *lexer) next() token {
+	for l.pos < len(l.src) && strings.IndexByte(" \t\r\n", l.src[l.pos]) >= 0 {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos == len(l.src) {
+		return token{kind: tEOF, pos: start}
+	}
+	c := l.src[l.pos]
+	switch {
+	case isLetter(c):
+		for l.pos < len(l.src) && (isLetter(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+			l.pos++
+		}
+		t := token{kind: tIdent, pos: start, text: l.src[start:l.pos]}
+		if t.text == "in" {
+			t.kind = tIn
+		}
+		return t
+	case isDigit(c):
+		return l.number()
+	case c == '"' || c == '`':
+		return l.string()
+	}
+	for _, op := range operators {
+		if strings.HasPrefix(l.src[l.pos:], op.text) {
+			l.pos += len(op.text)
+			return token{kind: op.kind, pos: start, text: op.text}
+		}
+	}
+	switch c {
+	case '&', '|':
+		panic(errorAt(l.src, start, "unexpected '%c', did you mean '%c%c'?", c, c, c))
+	case '=':
+		panic(errorAt(l.src, start, "unexpected '=', did you mean '=='?"))
+	}
+	r := []rune(l.src[start:])[0]
+	panic(errorAt(l.src, start, "unexpected character %q", r))
+}
+
+// number returns a number token.
+func (l *lexer) number() token {
+	start := l.pos
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if (c == '+' || c == '-') && (l.src[l.pos-1] == 'e' || l.src[l.pos-1] == 'E') {
+			l.pos++
+			continue
+		}
+		if !isDigit(c) && !isLetter(c) && c != '.' {
+			break
+		}
+		l.pos++
+	}
+	t := token{kind: tNumber, pos: start, text: l.src[start:l.pos]}
+	var err error
+	if t.num, err = strconv.ParseFloat(t.text, 64); err != nil || strings.ContainsAny(t.text, "_xXpP") {
+		panic(errorAt(l.src, start, "invalid number '%s'", t.text))
+	}
+	return t
+}
+
+// string returns a string token.
+func (l *lexer) string() token {
+	start := l.pos
+	quote := l.src[l.pos]
+	l.pos++
+	for l.pos < len(l.src) && l.src[l.pos] != quote {
+		if l.src[l.pos] == '\n' && quote == '"' {
+			break
+		}
+		if l.src[l.pos] == '\\' && quote == '"' {
+			l.pos++
+		}
+		l.pos++
+	}
+	if l.pos >= len(l.src) || l.src[l.pos] != quote {
+		panic(errorAt(l.src, start, "unterminated string"))
+	}
+	l.pos++
+	t := token{kind: tString, pos: start, text: l.src[start:l.pos]}
+	var err error
+	if t.val, err = strconv.Unquote(t.text); err != nil {
+		panic(errorAt(l.src, start, "invalid string %s", t.text))
+	}
+	return t
+}
+
+func isLetter(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
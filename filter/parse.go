@@ -0,0 +1,340 @@
+package filter
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxDepth is the maximum nesting depth of an expression.
+const maxDepth = 100
+
+// typ is the type of an expression.
+type typ int
+
+const (
+	tyBool typ = iota + 1
+	tyString
+	tyNumber
+	tyLevel
+)
+
+func (t typ) String() string {
+	return [...]string{"invalid", "bool", "string", "number", "level"}[t]
+}
+
+// node is a node of the syntax tree.
+type node interface {
+	pos() int
+	typ() typ
+}
+
+// base holds the position and the type of a node.
+type base struct {
+	p int
+	t typ
+}
+
+func (b *base) pos() int { return b.p }
+func (b *base) typ() typ { return b.t }
+
+type (
+	// nameNode is a message field, a level or a boolean constant.
+	nameNode struct {
+		base
+		name string
+		rank int // level rank of a level constant
+	}
+
+	// fieldNode is a structured field of the message.
+	fieldNode struct {
+		base
+		key string
+	}
+
+	// strNode is a string constant, or a level once type checked.
+	strNode struct {
+		base
+		val  string
+		rank int
+	}
+
+	numNode struct {
+		base
+		val float64
+	}
+
+	unaryNode struct {
+		base
+		op tokKind
+		x  node
+	}
+
+	binaryNode struct {
+		base
+		op    token
+		x, y  node
+		regex *regexp.Regexp // of ~ and !~
+	}
+
+	inNode struct {
+		base
+		x    node
+		list []node
+	}
+
+	callNode struct {
+		base
+		name string
+		args []node
+	}
+)
+
+// parser builds the syntax tree of an expression.
+type parser struct {
+	lex   lexer
+	tok   token
+	depth int
+}
+
+// parse returns the syntax tree of the expression src.
+func parse(src string) (n node, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			if err, _ = e.(*Error); err == nil {
+				panic(e)
+			}
+		}
+	}()
+	p := &parser{lex: lexer{src: src}}
+	p.next()
+	n = p.or()
+	if p.tok.kind != tEOF {
+		p.errorf("unexpected %s", p.tok)
+	}
+	return n, nil
+}
+
+func (p *parser) next() {
+	p.tok = p.lex.next()
+}
+
+func (p *parser) errorf(format string, args ...interface{}) {
+	panic(errorAt(p.lex.src, p.tok.pos, format, args...))
+}
+
+// expect skips the token of kind k, described by what.
+func (p *parser) expect(k tokKind, what string) token {
+	t := p.tok
+	if t.kind != k {
+		p.errorf("expected %s, found %s", what, t)
+	}
+	p.next()
+	return t
+}
+
+func (p *parser) or() node {
+	x := p.and()
+	for p.tok.kind == tOr {
+		op := p.tok
+		p.next()
+		x = &binaryNode{base: base{p: x.pos()}, op: op, x: x, y: p.and()}
+	}
+	return x
+}
+
+func (p *parser) and() node {
+	x := p.cmp()
+	for p.tok.kind == tAnd {
+		op := p.tok
+		p.next()
+		x = &binaryNode{base: base{p: x.pos()}, op: op, x: x, y: p.cmp()}
+	}
+	return x
+}
+
+func isComparison(k tokKind) bool {
+	return k >= tEq && k <= tNotMatch || k == tIn
+}
+
+func (p *parser) cmp() node {
+	x := p.unary()
+	op := p.tok
+	switch {
+	case op.kind == tIn:
+		p.next()
+		p.expect(tLParen, "'(' after in")
+		n := &inNode{base: base{p: x.pos()}, x: x}
+		for {
+			n.list = append(n.list, p.unary())
+			if p.tok.kind != tComma {
+				break
+			}
+			p.next()
+		}
+		p.expect(tRParen, "',' or ')'")
+		x = n
+	case isComparison(op.kind):
+		p.next()
+		x = &binaryNode{base: base{p: x.pos()}, op: op, x: x, y: p.unary()}
+	default:
+		return x
+	}
+	if isComparison(p.tok.kind) {
+		p.errorf("unexpected %s, comparisons cannot be chained", p.tok)
+	}
+	return x
+}
+
+func (p *parser) unary() node {
+	if p.depth++; p.depth > maxDepth {
+		p.errorf("expression nested too deeply")
+	}
+	defer func() { p.depth-- }()
+	t := p.tok
+	if t.kind == tNot || t.kind == tMinus {
+		p.next()
+		return &unaryNode{base: base{p: t.pos}, op: t.kind, x: p.unary()}
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() node {
+	t := p.tok
+	switch t.kind {
+	case tLParen:
+		p.next()
+		x := p.or()
+		p.expect(tRParen, "')'")
+		return x
+	case tString:
+		p.next()
+		return &strNode{base: base{p: t.pos}, val: t.val}
+	case tNumber:
+		p.next()
+		return &numNode{base: base{p: t.pos}, val: t.num}
+	case tIdent:
+		p.next()
+		if t.text == "fields" {
+			return p.field(t)
+		}
+		if p.tok.kind != tLParen {
+			return &nameNode{base: base{p: t.pos}, name: t.text}
+		}
+		p.next()
+		n := &callNode{base: base{p: t.pos}, name: t.text}
+		for p.tok.kind != tRParen {
+			n.args = append(n.args, p.or())
+			if p.tok.kind != tComma {
+				break
+			}
+			p.next()
+		}
+		p.expect(tRParen, "',' or ')'")
+		return n
+	}
+	p.errorf("expected operand, found %s", t)
+	return nil
+}
+
+// field parses a structured field after the name fields at t.
+func (p *parser) field(t token) node {
+	n := &fieldNode{base: base{p: t.pos}}
+	switch p.tok.kind {
+	case tDot:
+		p.next()
+		n.key = p.expect(tIdent, "field name after 'fields.'").text
+	case tLBrack:
+		p.next()
+		n.key = p.expect(tString, "field name string after 'fields['").val
+		p.expect(tRBrack, "']'")
+	default:
+		p.errorf("expected '.' or '[' after fields, found %s", p.tok)
+	}
+	return n
+}
+
+// format returns the source of the syntax tree n, with parentheses only
+// where required by the precedence of the operators.
+func format(n node) string {
+	return formatPrec(n, 0)
+}
+
+// precedence returns the precedence of the operator of node n, from 1 for
+// || to 4 for the unary operators and the operands.
+func precedence(n node) int {
+	switch n := n.(type) {
+	case *binaryNode:
+		switch n.op.kind {
+		case tOr:
+			return 1
+		case tAnd:
+			return 2
+		}
+		return 3
+	case *inNode:
+		return 3
+	}
+	return 4
+}
+
+// formatPrec returns the source of n in an operand of precedence prec.
+func formatPrec(n node, prec int) string {
+	var s string
+	switch n := n.(type) {
+	case *nameNode:
+		s = n.name
+	case *fieldNode:
+		if isName(n.key) {
+			s = "fields." + n.key
+		} else {
+			s = "fields[" + strconv.Quote(n.key) + "]"
+		}
+	case *strNode:
+		s = strconv.Quote(n.val)
+	case *numNode:
+		s = strconv.FormatFloat(n.val, 'g', -1, 64)
+	case *unaryNode:
+		if n.op == tNot {
+			s = "!" + formatPrec(n.x, 4)
+		} else {
+			s = "-" + formatPrec(n.x, 4)
+		}
+	case *binaryNode:
+		p := precedence(n)
+		if p == 3 {
+			s = formatPrec(n.x, 4) + " " + n.op.text + " " + formatPrec(n.y, 4)
+		} else {
+			s = formatPrec(n.x, p) + " " + n.op.text + " " + formatPrec(n.y, p+1)
+		}
+	case *inNode:
+		list := make([]string, len(n.list))
+		for i, x := range n.list {
+			list[i] = formatPrec(x, 4)
+		}
+		s = formatPrec(n.x, 4) + " in (" + strings.Join(list, ", ") + ")"
+	case *callNode:
+		args := make([]string, len(n.args))
+		for i, x := range n.args {
+			args[i] = formatPrec(x, 0)
+		}
+		s = n.name + "(" + strings.Join(args, ", ") + ")"
+	}
+	if precedence(n) < prec {
+		s = "(" + s + ")"
+	}
+	return s
+}
+
+// isName returns true if s is an identifier other than in.
+func isName(s string) bool {
+	if s == "" || s == "in" || !isLetter(s[0]) {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isLetter(s[i]) && !isDigit(s[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The Fluent Forward listener accepts the Message, Forward, PackedForward
+// and CompressedPackedForward modes of the Forward protocol v1. Each record
+// becomes a message with
+//   - System: the system key of the record, or the tag,
+//   - Component: the component key of the record,
+//   - Level: the level or severity key of the record (default info),
+//   - Message: the message, log or msg key of the record,
+// and the other keys of the record as fields. A chunk option is acknowledged
+// once all the records of the entry are queued. The shared key handshake is
+// not supported, use -tls to authenticate clients.
+
+var statForwardInvalid = newStatCounter("invalid forward")
+
+// handleForward reads the Forward protocol entries sent on conn.
+func handleForward(conn net.Conn, msgs chan msgInfo) {
+	defer conn.Close()
+	p := register(conn)
+	if p == nil {
+		return
+	}
+	defer p.done()
+	d := &msgpackReader{r: bufio.NewReader(conn)}
+	var (
+		ack    []byte
+		client *clientID
+	)
+	for {
+		// wait for the next entry, unless the server is stopping
+		p.setIdle(true)
+		conn.SetReadDeadline(time.Now().Add(time.Duration(*idleFlag) * time.Second))
+		if isStopping() && d.r.Buffered() == 0 {
+			return
+		}
+		_, err := d.r.Peek(1)
+		p.setIdle(false)
+		if err != nil && isStopping() {
+			return
+		}
+		if client == nil {
+			client = tlsIdentity(conn)
+		}
+		v, err := d.decode(*forwardMaxFlag)
+		if err != nil {
+			if err != io.EOF {
+				statForwardInvalid.inc()
+				log.Printf("forward recv error from %s: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		ms, chunk, err := forwardEntry(v, *forwardMaxFlag-d.left)
+		if err != nil {
+			statForwardInvalid.inc()
+			log.Printf("forward recv error from %s: %s", conn.RemoteAddr(), err)
+			return
+		}
+		var stored chan error
+		if chunk != "" {
+			stored = newStored(len(ms))
+		}
+		var (
+			rejected error
+			n        int
+		)
+		for _, m := range ms {
+			if *msgFlag {
+				log.Println("msg:", m.msg)
+			}
+			if authorize(client, &m.msg) != nil {
+				// dropped, the chunk is still acknowledged
+				continue
+			}
+			m.stored = stored
+			m.client = client
+			if err = enqueue(msgs, m); err != nil {
+				rejected = err
+			}
+			n++
+		}
+		if chunk == "" {
+			continue
+		}
+		if err = waitStored(stored, n); err == nil {
+			err = rejected
+		}
+		if err != nil {
+			// without ack, the client sends the chunk again
+			log.Printf("forward chunk from %s not stored: %s", conn.RemoteAddr(), err)
+			continue
+		}
+		ack = appendMsgpackString(append(ack[:0], 0x81, 0xa3, 'a', 'c', 'k'), chunk)
+		conn.SetWriteDeadline(time.Now().Add(timeOutDelay))
+		if _, err = conn.Write(ack); err != nil {
+			log.Printf("forward send ack error to %s: %s", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// forwardEntry returns the messages of the Forward protocol entry v of size
+// bytes and its chunk option.
+func forwardEntry(v interface{}, size int) ([]msgInfo, string, error) {
+	a, ok := v.([]interface{})
+	if !ok || len(a) < 2 || len(a) > 4 {
+		return nil, "", errors.New("entry is not an array of 2 to 4 values")
+	}
+	tag, ok := a[0].(string)
+	if !ok {
+		return nil, "", errors.New("tag is not a string")
+	}
+	// the option follows the events, or the record in Message mode
+	var option map[string]interface{}
+	switch a[1].(type) {
+	case []interface{}, []byte, string:
+		if len(a) == 3 {
+			option, _ = a[2].(map[string]interface{})
+		}
+	default:
+		if len(a) == 4 {
+			option, _ = a[3].(map[string]interface{})
+		}
+	}
+	chunk, _ := option["chunk"].(string)
+
+	var (
+		ms  []msgInfo
+		err error
+	)
+	switch e := a[1].(type) {
+	case []interface{}:
+		// Forward mode
+		ms = make([]msgInfo, 0, len(e))
+		for i := range e {
+			ev, ok := e[i].([]interface{})
+			if !ok || len(ev) != 2 {
+				return nil, "", errors.Errorf("event %d is not a [time, record] array", i)
+			}
+			m, err := forwardMsg(tag, ev[0], ev[1])
+			if err != nil {
+				return nil, "", errors.Wrapf(err, "event %d", i)
+			}
+			ms = append(ms, m)
+		}
+	case []byte:
+		ms, err = forwardPacked(tag, e, option["compressed"])
+	case string:
+		ms, err = forwardPacked(tag, []byte(e), option["compressed"])
+	default:
+		// Message mode
+		if len(a) < 3 {
+			return nil, "", errors.New("missing record")
+		}
+		var m msgInfo
+		m, err = forwardMsg(tag, a[1], a[2])
+		ms = []msgInfo{m}
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	for i := range ms {
+		ms[i].len = size / len(ms)
+	}
+	return ms, chunk, nil
+}
+
+// forwardPacked returns the messages of the PackedForward events in data,
+// gzip compressed when compressed is "gzip".
+func forwardPacked(tag string, data []byte, compressed interface{}) ([]msgInfo, error) {
+	var r io.Reader = bytes.NewReader(data)
+	switch compressed {
+	case nil, "text":
+	case "gzip":
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "packed events")
+		}
+		r = zr
+	default:
+		return nil, errors.Errorf("unsupported compression '%v'", compressed)
+	}
+	d := &msgpackReader{r: bufio.NewReader(r)}
+	left := *forwardMaxFlag
+	var ms []msgInfo
+	for {
+		v, err := d.decode(left)
+		if err == io.EOF {
+			return ms, nil
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "packed event %d", len(ms))
+		}
+		left = d.left
+		ev, ok := v.([]interface{})
+		if !ok || len(ev) != 2 {
+			return nil, errors.Errorf("packed event %d is not a [time, record] array", len(ms))
+		}
+		m, err := forwardMsg(tag, ev[0], ev[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "packed event %d", len(ms))
+		}
+		ms = append(ms, m)
+	}
+}
+
+// forwardMsg returns the message of the record with the time t.
+func forwardMsg(tag string, t, record interface{}) (msgInfo, error) {
+	var m msgInfo
+	rec, ok := record.(map[string]interface{})
+	if !ok {
+		return m, errors.New("record is not a map")
+	}
+	switch t := t.(type) {
+	case int64:
+		m.msg.Stamp = time.Unix(t, 0).UTC()
+	case uint64:
+		m.msg.Stamp = time.Unix(int64(t), 0).UTC()
+	case float64:
+		sec, frac := math.Modf(t)
+		m.msg.Stamp = time.Unix(int64(sec), int64(frac*1e9)).UTC()
+	case msgpackExt:
+		// EventTime
+		if t.typ != 0 || len(t.data) != 8 {
+			return m, errors.New("invalid event time")
+		}
+		sec := binary.BigEndian.Uint32(t.data)
+		nsec := binary.BigEndian.Uint32(t.data[4:])
+		m.msg.Stamp = time.Unix(int64(sec), int64(nsec)).UTC()
+	default:
+		return m, errors.New("invalid event time")
+	}
+
+	m.msg.System = truncate(tag, maxSystemLen)
+	if s := msgpackString(rec["system"]); s != "" {
+		m.msg.System = truncate(s, maxSystemLen)
+	}
+	m.msg.Component = truncate(msgpackString(rec["component"]), maxComponentLen)
+	msgKey := firstKey(rec, "message", "log", "msg")
+	m.msg.Message = truncate(strings.TrimRight(msgpackString(rec[msgKey]), "\r\n"), maxMessageLen)
+	levelKey := firstKey(rec, "level", "severity")
+	m.msg.Level = otlpLevel(0, msgpackString(rec[levelKey]))
+	for k, v := range rec {
+		if k != "system" && k != "component" && k != msgKey && k != levelKey {
+			setField(&m.msg, k, msgpackString(v))
+		}
+	}
+	return m, checkMsg(&m.msg)
+}
+
+// firstKey returns the first of keys present in rec, or "" when none is.
+func firstKey(rec map[string]interface{}, keys ...string) string {
+	for _, k := range keys {
+		if _, ok := rec[k]; ok {
+			return k
+		}
+	}
+	return ""
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	statHTTPRejected = newStatCounter("http rejected")
+	statHTTPBusy     = newStatCounter("http busy")
+)
+
+// httpRetryAfter is the Retry-After delay in seconds sent under backpressure.
+const httpRetryAfter = 1
+
+// listenHTTP serves the HTTP ingestion and WebSocket endpoints on address.
+// With -tls, it requires a client certificate signed by the root CA, as for
+// the DMON protocol.
+func listenHTTP(address string, msgs chan msgInfo, limiter *connLimiter) {
+	mux := http.NewServeMux()
+	mux.Handle("/v1/messages", &httpIngester{
+		msgs:   msgs,
+		maxLen: int64(*httpMaxFlag),
+		decode: func(r *http.Request, body io.Reader) ([]msgInfo, error) {
+			return decodeHTTPMessages(body)
+		},
+		reply:   jsonReply,
+		partial: jsonPartialReply,
+		okCode:  http.StatusAccepted,
+	})
+	mux.Handle("/v1/logs", &httpIngester{
+		msgs:    msgs,
+		maxLen:  int64(*httpMaxFlag),
+		decode:  decodeOTLP,
+		reply:   otlpReply,
+		partial: otlpPartialReply,
+		okCode:  http.StatusOK,
+	})
+	mux.Handle("/v1/ws", &wsHandler{msgs: msgs, limiter: limiter})
+	srv := &http.Server{Addr: address, Handler: mux}
+	log.Println("listen http:", address)
+
+	// the server is a producer until its pending requests are served
+	p := register(nil)
+	if p == nil {
+		return
+	}
+	onShutdown(func() {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*shutdownFlag)*time.Second)
+			srv.Shutdown(ctx)
+			cancel()
+			p.done()
+		}()
+	})
+	if err := serveHTTP(srv); err != http.ErrServerClosed {
+		log.Fatalln("failed listen http:", err)
+	}
+}
+
+// serveHTTP serves srv, with TLS and a client certificate signed by the root
+// CA when -tls is set.
+func serveHTTP(srv *http.Server) error {
+	if !*tlsFlag {
+		return srv.ListenAndServe()
+	}
+	srv.TLSConfig = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  certPool,
+	}
+	return srv.ListenAndServeTLS(serverCRTFilename, serverKeyFilename)
+}
+
+// httpIngester accepts messages posted in a request body, optionally gzip
+// encoded, decoded by decode. The response is sent by reply, with okCode
+// when all messages are accepted. A request is refused when the message
+// queue is above its high water mark, and otherwise its messages are all
+// queued, waiting for room if needed. If the queue stays full, the response
+// is sent by partial with the number of messages accepted, the first ones
+// of the request.
+type httpIngester struct {
+	msgs    chan msgInfo
+	maxLen  int64
+	decode  func(r *http.Request, body io.Reader) ([]msgInfo, error)
+	reply   func(w http.ResponseWriter, r *http.Request, code int, msg string)
+	partial func(w http.ResponseWriter, r *http.Request, accepted, total int, msg string)
+	okCode  int
+}
+
+// errUnsupportedMedia is returned by decode for an unsupported content type.
+var errUnsupportedMedia = errors.New("unsupported content type")
+
+func (h *httpIngester) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		h.fail(w, r, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if *overloadFlag == "block" && 100*len(h.msgs) >= highWater*cap(h.msgs) {
+		statHTTPBusy.inc()
+		w.Header().Set("Retry-After", strconv.Itoa(httpRetryAfter))
+		h.fail(w, r, http.StatusTooManyRequests, "server is busy")
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, h.maxLen)
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			h.fail(w, r, http.StatusBadRequest, "invalid gzip body")
+			return
+		}
+		defer zr.Close()
+		body = &limitedReader{r: zr, n: h.maxLen}
+	default:
+		h.fail(w, r, http.StatusUnsupportedMediaType, "unsupported content encoding")
+		return
+	}
+
+	ms, err := h.decode(r, body)
+	if err != nil {
+		switch cause := errors.Cause(err); {
+		case cause == errTooLarge:
+			h.fail(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("body larger than %d bytes", h.maxLen))
+		case cause == errUnsupportedMedia:
+			h.fail(w, r, http.StatusUnsupportedMediaType, err.Error())
+		default:
+			if _, ok := cause.(*http.MaxBytesError); ok {
+				h.fail(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("body larger than %d bytes", h.maxLen))
+			} else {
+				h.fail(w, r, http.StatusBadRequest, err.Error())
+			}
+		}
+		return
+	}
+
+	var client *clientID
+	if r.TLS != nil {
+		client = certIdentity(r.TLS.PeerCertificates)
+	}
+	for i := range ms {
+		if err = authorize(client, &ms[i].msg); err != nil {
+			h.fail(w, r, http.StatusForbidden, err.Error())
+			return
+		}
+	}
+	stored := newStored(len(ms))
+	n := 0
+	for ; n < len(ms); n++ {
+		ms[n].client = client
+		ms[n].stored = stored
+		if enqueue(h.msgs, ms[n]) != nil {
+			break
+		}
+	}
+	results := n
+	if n < len(ms) {
+		// the rejected message has a result too
+		results++
+	}
+	if err = waitStored(stored, results); err != nil && err != errQueueTimeout {
+		w.Header().Set("Retry-After", strconv.Itoa(httpRetryAfter))
+		h.fail(w, r, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if n < len(ms) {
+		statHTTPBusy.inc()
+		statHTTPRejected.inc()
+		w.Header().Set("Retry-After", strconv.Itoa(httpRetryAfter))
+		h.partial(w, r, n, len(ms), "queue full")
+		return
+	}
+	h.reply(w, r, h.okCode, fmt.Sprintf("accepted %d messages", len(ms)))
+}
+
+// fail sends an error response.
+func (h *httpIngester) fail(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	statHTTPRejected.inc()
+	h.reply(w, r, code, msg)
+}
+
+// jsonReply sends the status code with msg in a JSON body.
+func jsonReply(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+	}{code, msg})
+}
+
+// jsonPartialReply sends a 503 status with the number of messages accepted,
+// which must not be sent again.
+func jsonPartialReply(w http.ResponseWriter, r *http.Request, accepted, total int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(struct {
+		Status   int    `json:"status"`
+		Message  string `json:"message"`
+		Accepted int    `json:"accepted"`
+	}{http.StatusServiceUnavailable, fmt.Sprintf("%s, accepted %d of %d messages", msg, accepted, total), accepted})
+}
+
+// decodeHTTPMessages decodes and checks the messages of a request body.
+func decodeHTTPMessages(body io.Reader) ([]msgInfo, error) {
+	br := bufio.NewReader(body)
+	var ms []msgInfo
+	add := func(data []byte) error {
+		var m msgInfo
+		if err := m.msg.JSONDecode(data); err != nil {
+			return errors.Wrapf(err, "message %d", len(ms))
+		}
+		if err := checkMsg(&m.msg); err != nil {
+			return errors.Wrapf(err, "message %d", len(ms))
+		}
+		m.len = len(data)
+		ms = append(ms, m)
+		return nil
+	}
+
+	// a JSON array of messages
+	first, err := firstNonSpace(br)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(br)
+	if first == '[' {
+		var raws []json.RawMessage
+		if err = dec.Decode(&raws); err != nil {
+			return nil, errors.Wrap(err, "decode array")
+		}
+		for _, raw := range raws {
+			if err = add(raw); err != nil {
+				return nil, err
+			}
+		}
+		return ms, nil
+	}
+
+	// a single JSON object or newline delimited JSON objects
+	for {
+		var raw json.RawMessage
+		if err = dec.Decode(&raw); err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "decode message %d", len(ms))
+		}
+		if err = add(raw); err != nil {
+			return nil, err
+		}
+	}
+	if len(ms) == 0 {
+		return nil, errors.New("no message")
+	}
+	return ms, nil
+}
+
+// firstNonSpace returns the first non white space byte of br without
+// consuming it.
+func firstNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			return 0, errors.New("empty body")
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !bytes.ContainsRune([]byte(" \t\r\n"), rune(b)) {
+			return b, br.UnreadByte()
+		}
+	}
+}
+
+var errTooLarge = errors.New("body too large")
+
+// limitedReader returns errTooLarge when more than n bytes are read.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	if l.n -= int64(n); l.n < 0 {
+		return n, errTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestHTTPQueueFull checks that the messages of a request are all queued
+// when the queue drains, that the accepted messages are reported when it
+// stays full with the block policy, and that the other policies apply.
+func TestHTTPQueueFull(t *testing.T) {
+	defer func(p string, to int) { *overloadFlag, *queueTOFlag = p, to }(*overloadFlag, *queueTOFlag)
+	*queueTOFlag = 1
+	body := strings.Repeat(`{"level": "info", "system": "s", "component": "c", "message": "m"}`+"\n", 5)
+	tests := []struct {
+		policy   string
+		stalled  bool
+		code     int
+		accepted int // reported in a partial reply
+		queued   int
+	}{
+		{"block", false, http.StatusAccepted, 0, 5},
+		{"block", true, http.StatusServiceUnavailable, 2, 2},
+		{"drop-newest", true, http.StatusAccepted, 0, 2},
+		{"drop-level", true, http.StatusAccepted, 0, 2},
+	}
+	for _, test := range tests {
+		*overloadFlag = test.policy
+		msgs := make(chan msgInfo, 2)
+		h := &httpIngester{
+			msgs:   msgs,
+			maxLen: 1 << 20,
+			decode: func(r *http.Request, body io.Reader) ([]msgInfo, error) {
+				return decodeHTTPMessages(body)
+			},
+			reply:   jsonReply,
+			partial: jsonPartialReply,
+			okCode:  http.StatusAccepted,
+		}
+		done := make(chan int)
+		go func() {
+			n := 0
+			if !test.stalled {
+				for range msgs {
+					n++
+				}
+			}
+			done <- n
+		}()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/v1/messages", strings.NewReader(body)))
+		var resp struct{ Accepted int }
+		json.NewDecoder(w.Body).Decode(&resp)
+		close(msgs)
+		n := <-done
+		if test.stalled {
+			n = len(msgs)
+		}
+		if w.Code != test.code || resp.Accepted != test.accepted || n != test.queued {
+			t.Errorf("%s stalled %v: got status %d, %d accepted and %d queued, expected %d, %d and %d", test.policy, test.stalled,
+				w.Code, resp.Accepted, n, test.code, test.accepted, test.queued)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strings"
+)
+
+// clientID is the identity of a client authenticated by its TLS certificate,
+// as opposed to the System it declares in its messages.
+type clientID struct {
+	cn   string   // subject common name
+	ous  []string // subject organizational units
+	sans []string // subject alternative names, as DNS:, IP:, URI: or email:
+}
+
+// tlsIdentity returns the identity of the client of conn, or nil if conn is
+// not a TLS connection with a client certificate. The TLS handshake must be
+// complete.
+func tlsIdentity(conn net.Conn) *clientID {
+	for {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			return certIdentity(c.ConnectionState().PeerCertificates)
+		case *wsConn:
+			conn = c.Conn
+		case *syncConn:
+			conn = c.Conn
+		default:
+			return nil
+		}
+	}
+}
+
+// certIdentity returns the identity in the leaf certificate of certs, or nil
+// if certs is empty.
+func certIdentity(certs []*x509.Certificate) *clientID {
+	if len(certs) == 0 {
+		return nil
+	}
+	cert := certs[0]
+	id := &clientID{cn: cert.Subject.CommonName, ous: cert.Subject.OrganizationalUnit}
+	for _, n := range cert.DNSNames {
+		id.sans = append(id.sans, "DNS:"+n)
+	}
+	for _, ip := range cert.IPAddresses {
+		id.sans = append(id.sans, "IP:"+ip.String())
+	}
+	for _, u := range cert.URIs {
+		id.sans = append(id.sans, "URI:"+u.String())
+	}
+	for _, e := range cert.EmailAddresses {
+		id.sans = append(id.sans, "email:"+e)
+	}
+	return id
+}
+
+// san returns the subject alternative names separated by commas.
+func (id *clientID) san() string {
+	return strings.Join(id.sans, ",")
+}
+
+func (id *clientID) String() string {
+	if len(id.sans) == 0 {
+		return "CN=" + id.cn
+	}
+	return "CN=" + id.cn + " (" + id.san() + ")"
+}
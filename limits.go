@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	statTooLarge     = newStatCounter("too large")
+	statConnLimit    = newStatCounter("conn limit")
+	statIPLimit      = newStatCounter("ip limit")
+	statHandshakeTO  = newStatCounter("handshake timeout")
+	statBudgetExceed = newStatCounter("mem budget")
+)
+
+// connLimiter limits the number of concurrent connections, in total and per
+// remote IP address.
+type connLimiter struct {
+	mtx   sync.Mutex
+	max   int
+	maxIP int
+	n     int
+	perIP map[string]int
+}
+
+func newConnLimiter(max, maxIP int) *connLimiter {
+	return &connLimiter{max: max, maxIP: maxIP, perIP: make(map[string]int)}
+}
+
+// acquire reserves a connection slot for addr. It must be released with
+// release when the connection is closed. Unix socket connections are only
+// subject to the total limit.
+func (l *connLimiter) acquire(addr net.Addr) error {
+	ip := remoteIP(addr)
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.max > 0 && l.n >= l.max {
+		statConnLimit.inc()
+		return errors.Errorf("too many connections (max %d)", l.max)
+	}
+	if l.maxIP > 0 && ip != "" && l.perIP[ip] >= l.maxIP {
+		statIPLimit.inc()
+		return errors.Errorf("too many connections from %s (max %d)", ip, l.maxIP)
+	}
+	l.n++
+	if ip != "" {
+		l.perIP[ip]++
+	}
+	return nil
+}
+
+// release frees the connection slot reserved for addr.
+func (l *connLimiter) release(addr net.Addr) {
+	ip := remoteIP(addr)
+	l.mtx.Lock()
+	l.n--
+	if ip != "" {
+		if l.perIP[ip]--; l.perIP[ip] <= 0 {
+			delete(l.perIP, ip)
+		}
+	}
+	l.mtx.Unlock()
+}
+
+// remoteIP returns the IP address of addr without the port, or an empty
+// string for a Unix socket address.
+func remoteIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case *net.UnixAddr:
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// budget limits the number of bytes of the messages of a connection waiting
+// in the message queue or in the sink buffers.
+type budget struct {
+	used int64
+	max  int64
+}
+
+// acquire reserves n bytes and returns false if it would exceed the budget.
+func (b *budget) acquire(n int) bool {
+	if b == nil || b.max <= 0 {
+		return true
+	}
+	if atomic.AddInt64(&b.used, int64(n)) > b.max {
+		atomic.AddInt64(&b.used, -int64(n))
+		statBudgetExceed.inc()
+		return false
+	}
+	return true
+}
+
+// release frees n bytes reserved with acquire.
+func (b *budget) release(n int) {
+	if b != nil && b.max > 0 {
+		atomic.AddInt64(&b.used, -int64(n))
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The line listener accepts messages as text lines, with the fields
+// separated by a delimiter or in logfmt. The template lists the message
+// fields as they appear in the line:
+//   - stamp, level, system, component and message set the message fields,
+//   - any other name sets a field of the message,
+//   - "-" ignores the value.
+// With a delimiter, the values are taken in template order and the last one
+// extends to the end of the line. In logfmt, a template entry may be given as
+// name=key to take the value of another key, and the keys not in the
+// template become fields. A line without stamp gets the receive time. The
+// stamp is in RFC 3339 or in seconds since the epoch.
+
+var statLineInvalid = newStatCounter("invalid line")
+
+// Default templates of the line formats.
+const (
+	defaultLineTemplate   = "level,system,component,message"
+	defaultLogfmtTemplate = "stamp=time,level,system,component,message=msg"
+)
+
+// lineFormat decodes the messages of a line listener.
+type lineFormat struct {
+	delim  string // "" for logfmt
+	fields []lineField
+}
+
+// lineField is a template entry.
+type lineField struct {
+	name, key string
+}
+
+// newLineFormat returns the line format with the given delimiter, or logfmt,
+// and template. An empty template selects the default one.
+func newLineFormat(format, template string) (*lineFormat, error) {
+	f := &lineFormat{delim: format}
+	if format == "logfmt" {
+		f.delim = ""
+		if template == "" {
+			template = defaultLogfmtTemplate
+		}
+	} else if format == "" {
+		return nil, errors.New("empty delimiter")
+	}
+	if template == "" {
+		template = defaultLineTemplate
+	}
+	for _, e := range strings.Split(template, ",") {
+		var lf lineField
+		lf.name = strings.TrimSpace(e)
+		if i := strings.IndexByte(lf.name, '='); i >= 0 {
+			if f.delim != "" {
+				return nil, errors.Errorf("template entry '%s' requires logfmt", lf.name)
+			}
+			lf.name, lf.key = lf.name[:i], lf.name[i+1:]
+		}
+		if lf.key == "" {
+			lf.key = lf.name
+		}
+		if lf.name == "" {
+			return nil, errors.Errorf("empty template entry in '%s'", template)
+		}
+		f.fields = append(f.fields, lf)
+	}
+	return f, nil
+}
+
+// handle reads the lines sent on conn. Invalid lines are counted and
+// skipped.
+func (f *lineFormat) handle(conn net.Conn, msgs chan msgInfo) {
+	defer conn.Close()
+	p := register(conn)
+	if p == nil {
+		return
+	}
+	defer p.done()
+	r := bufio.NewReaderSize(conn, *maxFrameFlag)
+	var client *clientID
+	for {
+		// wait for the next line, unless the server is stopping
+		p.setIdle(true)
+		conn.SetReadDeadline(time.Now().Add(time.Duration(*idleFlag) * time.Second))
+		if isStopping() && r.Buffered() == 0 {
+			return
+		}
+		_, err := r.Peek(1)
+		p.setIdle(false)
+		if err != nil && isStopping() {
+			return
+		}
+		if client == nil {
+			client = tlsIdentity(conn)
+		}
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			statLineInvalid.inc()
+			if *msgFlag {
+				log.Printf("line from %s longer than %d bytes", conn.RemoteAddr(), *maxFrameFlag)
+			}
+			for err == bufio.ErrBufferFull {
+				_, err = r.ReadSlice('\n')
+			}
+			continue
+		}
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			if err != io.EOF {
+				log.Printf("line recv error from %s: %s", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		text := strings.TrimRight(string(line), "\r\n")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		m, err := f.decode(text)
+		if err != nil {
+			statLineInvalid.inc()
+			if *msgFlag {
+				log.Printf("invalid line from %s: %s", conn.RemoteAddr(), err)
+			}
+			continue
+		}
+		if *msgFlag {
+			log.Println("msg:", m.msg)
+		}
+		m.client = client
+		if authorize(client, &m.msg) != nil {
+			continue
+		}
+		enqueue(msgs, m)
+	}
+}
+
+// decode returns the message of the line.
+func (f *lineFormat) decode(line string) (msgInfo, error) {
+	m := msgInfo{len: len(line)}
+	var err error
+	if f.delim != "" {
+		values := strings.SplitN(line, f.delim, len(f.fields))
+		if len(values) < len(f.fields) {
+			return m, errors.Errorf("%d values instead of %d", len(values), len(f.fields))
+		}
+		for i, lf := range f.fields {
+			if err = m.set(lf.name, strings.TrimSpace(values[i])); err != nil {
+				return m, err
+			}
+		}
+	} else {
+		kvs, err := parseLogfmt(line)
+		if err != nil {
+			return m, err
+		}
+		for _, lf := range f.fields {
+			if v, ok := kvs[lf.key]; ok {
+				if err = m.set(lf.name, v); err != nil {
+					return m, err
+				}
+				delete(kvs, lf.key)
+			}
+		}
+		for k, v := range kvs {
+			setField(&m.msg, k, v)
+		}
+	}
+	if m.msg.Level == "" {
+		m.msg.Level = "info"
+	}
+	if m.msg.Stamp.IsZero() {
+		m.msg.Stamp = time.Now().UTC()
+	}
+	return m, checkMsg(&m.msg)
+}
+
+// set sets the template field name of the message to v.
+func (m *msgInfo) set(name, v string) error {
+	switch name {
+	case "-":
+	case "stamp":
+		if v == "" {
+			return nil
+		}
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			m.msg.Stamp = t.UTC()
+			return nil
+		}
+		sec, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return errors.Errorf("invalid stamp '%s'", v)
+		}
+		m.msg.Stamp = time.Unix(0, int64(sec*1e9)).UTC()
+	case "level":
+		m.msg.Level = strings.ToLower(v)
+	case "system":
+		m.msg.System = v
+	case "component":
+		m.msg.Component = v
+	case "message":
+		m.msg.Message = v
+	default:
+		setField(&m.msg, name, v)
+	}
+	return nil
+}
+
+// parseLogfmt returns the key value pairs of the logfmt line. Values may be
+// double quoted with Go escape sequences, and a key without value has an
+// empty value.
+func parseLogfmt(line string) (map[string]string, error) {
+	kvs := make(map[string]string)
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return kvs, nil
+		}
+		i := strings.IndexAny(line, "= \t")
+		if i == 0 {
+			return nil, errors.New("missing key")
+		}
+		if i < 0 {
+			i = len(line)
+		}
+		key := line[:i]
+		line = line[i:]
+		if line == "" || line[0] != '=' {
+			kvs[key] = ""
+			continue
+		}
+		line = line[1:]
+		var v string
+		if strings.HasPrefix(line, `"`) {
+			j := 1
+			for j < len(line) && line[j] != '"' {
+				if line[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(line) {
+				return nil, errors.Errorf("unterminated value of key '%s'", key)
+			}
+			var err error
+			if v, err = strconv.Unquote(line[:j+1]); err != nil {
+				return nil, errors.Errorf("invalid value of key '%s'", key)
+			}
+			line = line[j+1:]
+		} else {
+			j := strings.IndexAny(line, " \t")
+			if j < 0 {
+				j = len(line)
+			}
+			v, line = line[:j], line[j:]
+		}
+		kvs[key] = v
+	}
+}
@@ -6,25 +6,61 @@ import (
 	"io/ioutil"
 	"log"
 	"path/filepath"
+	"time"
 
 	"github.com/pkg/profile"
 )
 
 var (
-	rootCAFilename = filepath.Join("pki", "rootCA.crt")
-	certPool       = x509.NewCertPool()
-	serverFlag     = flag.Bool("s", false, "run as server")
-	clientFlag     = flag.Bool("c", false, "run as client")
-	addressFlag    = flag.String("a", "127.0.0.1:3000", "server: listen address, client: message destination")
-	pkiFlag        = flag.Bool("k", false, "(re)generate private keys and certificates")
-	dbFlag         = flag.Bool("db", false, "store monitoring messages in database")
-	tlsFlag        = flag.Bool("tls", false, "use TLS connection (default tcp)")
-	jsonFlag       = flag.Bool("json", false, "use json encoding (default binary)")
-	cpuFlag        = flag.Bool("cpu", false, "enable CPU profiling")
-	periodFlag     = flag.Int("p", 5, "stat display period in seconds")
-	dbFlushFlag    = flag.Int("dbp", 1000, "database flush period in milliseconds")
-	dbBufLenFlag   = flag.Int("dbl", 10, "database buffer length")
-	msgFlag        = flag.Bool("m", false, "display received messages")
+	rootCAFilename  = filepath.Join("pki", "rootCA.crt")
+	certPool        = x509.NewCertPool()
+	serverFlag      = flag.Bool("s", false, "run as server")
+	clientFlag      = flag.Bool("c", false, "run as client")
+	addressFlag     = flag.String("a", "127.0.0.1:3000", "server: listen address, client: message destination (udp://host:port, unix://path or ws://host:port/v1/ws)")
+	pkiFlag         = flag.Bool("k", false, "(re)generate private keys and certificates")
+	dbFlag          = flag.Bool("db", false, "store monitoring messages in database")
+	tlsFlag         = flag.Bool("tls", false, "use TLS connection (default tcp)")
+	jsonFlag        = flag.Bool("json", false, "use json encoding (default binary)")
+	cpuFlag         = flag.Bool("cpu", false, "enable CPU profiling")
+	periodFlag      = flag.Int("p", 5, "stat display period in seconds")
+	dbFlushFlag     = flag.Int("dbp", 1000, "database flush period in milliseconds")
+	dbBufLenFlag    = flag.Int("dbl", 10, "database buffer length")
+	msgFlag         = flag.Bool("m", false, "display received messages")
+	windowFlag      = flag.Int("w", 0, "client: max number of unacknowledged messages (0: stop-and-wait)")
+	handshakeFlag   = flag.Bool("hs", true, "client: negotiate codec and compression with the server")
+	nameFlag        = flag.String("n", "dmon", "client: name declared in the handshake")
+	compressFlag    = flag.Bool("z", false, "client: request deflate compression")
+	heartbeatFlag   = flag.Int("hb", 10, "client: heartbeat period in seconds on idle connections (0: none)")
+	idleFlag        = flag.Int("idle", 60, "server: idle connection timeout in seconds")
+	ioTimeoutFlag   = flag.Int("iot", 30, "I/O timeout in seconds")
+	maxFrameFlag    = flag.Int("maxframe", 64*1024, "server: max frame payload size in bytes")
+	maxConnFlag     = flag.Int("maxconn", 1000, "server: max number of concurrent connections (0: no limit)")
+	maxConnIPFlag   = flag.Int("maxconnip", 100, "server: max number of concurrent connections per IP (0: no limit)")
+	handshakeTOFlag = flag.Int("hst", 10, "server: handshake timeout in seconds")
+	udpFlag         = flag.String("udp", "", "server: also listen for datagrams on this UDP address")
+	unixFlag        = flag.String("unix", "", "server: also listen on this Unix socket path")
+	unixModeFlag    = flag.String("unixmode", "0660", "server: Unix socket file mode")
+	unixOwnerFlag   = flag.String("unixowner", "", "server: Unix socket owner as user[:group]")
+	httpFlag        = flag.String("http", "", "server: also accept messages posted, OTLP logs or WebSocket connections on this HTTP address")
+	httpMaxFlag     = flag.Int("httpmax", 1<<20, "server: max HTTP request body size in bytes")
+	mtuFlag         = flag.Int("mtu", 1400, "client: max datagram size with a udp:// address")
+	connMemFlag     = flag.Int("connmem", 1<<20, "server: max bytes of queued messages per connection (0: no limit)")
+	forwardFlag     = flag.String("forward", "", "server: also accept Fluent Forward protocol connections on this address")
+	forwardMaxFlag  = flag.Int("forwardmax", 8<<20, "server: max Fluent Forward entry size in bytes")
+	lineFlag        = flag.String("line", "", "server: also accept text lines on this TCP address")
+	lineFormatFlag  = flag.String("lineformat", "|", "server: line field delimiter, or logfmt")
+	lineTemplFlag   = flag.String("linetemplate", "", "server: line fields as a list of stamp, level, system, component, message, - or field names (default depends on -lineformat)")
+	shutdownFlag    = flag.Int("shutdown", 10, "server: graceful shutdown deadline in seconds")
+	durableFlag     = flag.String("durable", "", "server: acknowledge messages once stored in the database (db) or fsynced to the journal (journal)")
+	journalFlag     = flag.String("journal", "dmon.journal", "server: journal file of the durable journal mode")
+	overloadFlag    = flag.String("overload", "block", "server: policy when the message queue is full (block, drop-newest, drop-oldest, drop-level or spill)")
+	queueTOFlag     = flag.Int("queuetimeout", 0, "server: max seconds to wait for room in the message queue with the block and drop-level policies (0: no limit)")
+	spillFlag       = flag.String("spill", "dmon.spill", "server: spill file of the spill overload policy")
+	configFlag      = flag.String("config", "", "server: configuration file of the sinks (default: mysql with -db, ring otherwise)")
+	policyFlag      = flag.String("policy", "", "server: authorization policy file of the clients, reloaded on SIGHUP")
+	tailMaxFlag     = flag.Int("tailmax", 8, "server: max number of tail subscribers (0: none)")
+	tailFmtFlag     = flag.String("tailfmt", "short", "tail: output format (short, text or json)")
+	adminFlag       = flag.String("admin", "", "server: HTTP address of the admin endpoints, e.g. /v1/recent")
 )
 
 // For TLS client server, see
@@ -38,6 +74,12 @@ var (
 func main() {
 
 	flag.Parse()
+	timeOutDelay = time.Duration(*ioTimeoutFlag) * time.Second
+
+	if flag.Arg(0) == "route-test" {
+		routeTest(flag.Args()[1:])
+		return
+	}
 
 	if *cpuFlag {
 		defer profile.Start().Stop()
@@ -57,6 +99,8 @@ func main() {
 	}
 
 	switch {
+	case flag.Arg(0) == "tail":
+		runTail(flag.Args()[1:])
 	case *serverFlag:
 		runAsServer()
 	case *clientFlag:
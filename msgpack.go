@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// msgpackReader decodes msgpack values. Strings and binary data are returned
+// as string and []byte, maps as map[string]interface{} with their keys
+// converted to strings, integers as int64 or uint64, floats as float64, and
+// extension types as msgpackExt.
+type msgpackReader struct {
+	r    *bufio.Reader
+	left int // max number of bytes of the value being read
+}
+
+// msgpackExt is a msgpack extension value.
+type msgpackExt struct {
+	typ  int8
+	data []byte
+}
+
+var errMsgpackTooLarge = errors.New("msgpack value too large")
+
+// maxMsgpackDepth is the maximum nesting depth of arrays and maps.
+const maxMsgpackDepth = 32
+
+// maxMsgpackPrealloc is the maximum number of elements preallocated for an
+// array or a map, whose announced size is not trusted.
+const maxMsgpackPrealloc = 1024
+
+// decode reads the next value, limited to maxLen bytes. It returns io.EOF
+// only when the input ends before the value.
+func (d *msgpackReader) decode(maxLen int) (interface{}, error) {
+	d.left = maxLen
+	v, err := d.value(0)
+	if err == io.EOF && d.left < maxLen-1 {
+		err = io.ErrUnexpectedEOF
+	}
+	return v, err
+}
+
+func (d *msgpackReader) next(n int) ([]byte, error) {
+	if n > d.left {
+		return nil, errMsgpackTooLarge
+	}
+	d.left -= n
+	buf := make([]byte, n)
+	_, err := io.ReadFull(d.r, buf)
+	return buf, err
+}
+
+func (d *msgpackReader) uint(n int) (uint64, error) {
+	buf, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, b := range buf {
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+func (d *msgpackReader) value(depth int) (interface{}, error) {
+	if depth > maxMsgpackDepth {
+		return nil, errors.New("msgpack value too deep")
+	}
+	buf, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	b := buf[0]
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xe0 == 0xa0:
+		return d.str(int(b & 0x1f))
+	case b&0xf0 == 0x90:
+		return d.array(int(b&0x0f), depth)
+	case b&0xf0 == 0x80:
+		return d.mapping(int(b&0x0f), depth)
+	}
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (b - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return d.bin(n)
+	case 0xca:
+		v, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := d.uint(8)
+		return math.Float64frombits(v), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.uint(1 << (b - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (b - 0xd0)
+		v, err := d.uint(size)
+		shift := uint(64 - 8*size)
+		return int64(v<<shift) >> shift, err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (b - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.strn(n)
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (b - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.arrayn(n, depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (b - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mappingn(n, depth)
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.ext(1 << (b - 0xd4))
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.uint(1 << (b - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(d.left) {
+			return nil, errMsgpackTooLarge
+		}
+		return d.ext(int(n))
+	}
+	return nil, errors.Errorf("invalid msgpack byte 0x%02x", b)
+}
+
+func (d *msgpackReader) strn(n uint64) (interface{}, error) {
+	if n > uint64(d.left) {
+		return nil, errMsgpackTooLarge
+	}
+	return d.str(int(n))
+}
+
+func (d *msgpackReader) str(n int) (interface{}, error) {
+	buf, err := d.next(n)
+	return string(buf), err
+}
+
+func (d *msgpackReader) bin(n uint64) (interface{}, error) {
+	if n > uint64(d.left) {
+		return nil, errMsgpackTooLarge
+	}
+	return d.next(int(n))
+}
+
+func (d *msgpackReader) ext(n int) (interface{}, error) {
+	buf, err := d.next(1 + n)
+	if err != nil {
+		return nil, err
+	}
+	return msgpackExt{typ: int8(buf[0]), data: buf[1:]}, nil
+}
+
+func (d *msgpackReader) arrayn(n uint64, depth int) (interface{}, error) {
+	if n > uint64(d.left) {
+		return nil, errMsgpackTooLarge
+	}
+	return d.array(int(n), depth)
+}
+
+func (d *msgpackReader) array(n int, depth int) (interface{}, error) {
+	a := make([]interface{}, 0, d.prealloc(n))
+	for i := 0; i < n; i++ {
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, v)
+	}
+	return a, nil
+}
+
+// prealloc returns the number of elements to preallocate for an array or a
+// map of n elements, each encoded in at least one byte.
+func (d *msgpackReader) prealloc(n int) int {
+	if n > d.left {
+		n = d.left
+	}
+	if n > maxMsgpackPrealloc {
+		n = maxMsgpackPrealloc
+	}
+	return n
+}
+
+func (d *msgpackReader) mappingn(n uint64, depth int) (interface{}, error) {
+	if n > uint64(d.left) {
+		return nil, errMsgpackTooLarge
+	}
+	return d.mapping(int(n), depth)
+}
+
+func (d *msgpackReader) mapping(n int, depth int) (interface{}, error) {
+	m := make(map[string]interface{}, d.prealloc(n))
+	for i := 0; i < n; i++ {
+		k, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		m[msgpackString(k)] = v
+	}
+	return m, nil
+}
+
+// msgpackString returns the string representation of a decoded value.
+// Strings are returned as is, and arrays and maps in JSON.
+func msgpackString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case msgpackExt:
+		return ""
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i := range v {
+			a[i] = msgpackJSON(v[i])
+		}
+		return anyString(a)
+	case map[string]interface{}:
+		return anyString(msgpackJSON(v))
+	}
+	return anyString(v)
+}
+
+// msgpackJSON returns v with its binary data converted to strings so that
+// it can be marshalled in JSON.
+func msgpackJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case msgpackExt:
+		return nil
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i := range v {
+			a[i] = msgpackJSON(v[i])
+		}
+		return a
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = msgpackJSON(e)
+		}
+		return m
+	}
+	return v
+}
+
+// appendMsgpackString appends the msgpack encoded string s to buf.
+func appendMsgpackString(buf []byte, s string) []byte {
+	switch {
+	case len(s) < 32:
+		buf = append(buf, 0xa0|byte(len(s)))
+	case len(s) < 1<<8:
+		buf = append(buf, 0xd9, byte(len(s)))
+	case len(s) < 1<<16:
+		buf = append(buf, 0xda, 0, 0)
+		binary.BigEndian.PutUint16(buf[len(buf)-2:], uint16(len(s)))
+	default:
+		buf = append(buf, 0xdb, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(buf[len(buf)-4:], uint32(len(s)))
+	}
+	return append(buf, s...)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"runtime"
+	"testing"
+)
+
+// TestMsgpackLargeCount checks that the announced number of elements of a
+// truncated array or map is not allocated.
+func TestMsgpackLargeCount(t *testing.T) {
+	const maxLen = 1 << 24
+	for _, data := range [][]byte{
+		{0xdd, 0x00, 0xff, 0xff, 0x00, 0x01}, // array32
+		{0xdf, 0x00, 0xff, 0xff, 0x00, 0x01}, // map32
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		d := &msgpackReader{r: bufio.NewReader(bytes.NewReader(data))}
+		if _, err := d.decode(maxLen); err == nil {
+			t.Errorf("%x: no error", data[0])
+		}
+		runtime.ReadMemStats(&after)
+		if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+			t.Errorf("%x: allocated %d bytes", data[0], n)
+		}
+	}
+}
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chmike/go-dmon/dmon"
+	"github.com/pkg/errors"
+)
+
+// The OTLP/HTTP logs receiver accepts ExportLogsServiceRequest messages in
+// protobuf or JSON encoding. Each log record becomes a message with
+//   - System: the service.name resource attribute,
+//   - Component: the instrumentation scope name,
+//   - Level: the severity number, or the severity text when not set,
+//   - Message: the body,
+// and the other resource and record attributes, the scope version, and the
+// trace and span ids as fields. The fields longer than allowed in a message
+// are truncated.
+
+// otlpRecord is a decoded log record with its resource and scope.
+type otlpRecord struct {
+	resource map[string]string
+	scope    string
+	version  string
+	time     uint64
+	observed uint64
+	sevNum   int64
+	sevText  string
+	body     string
+	attrs    map[string]string
+	traceID  string
+	spanID   string
+}
+
+// decodeOTLP decodes the logs export request in body.
+func decodeOTLP(r *http.Request, body io.Reader) ([]msgInfo, error) {
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	var recs []otlpRecord
+	switch ct {
+	case "application/x-protobuf":
+		recs, err = decodeOTLPProto(data)
+	case "application/json":
+		recs, err = decodeOTLPJSON(data)
+	default:
+		return nil, errors.Wrapf(errUnsupportedMedia, "'%s'", ct)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "decode logs")
+	}
+	ms := make([]msgInfo, 0, len(recs))
+	if len(recs) == 0 {
+		return ms, nil
+	}
+	for i := range recs {
+		m := msgInfo{msg: recs[i].msg(), len: len(data) / len(recs)}
+		if err = checkMsg(&m.msg); err != nil {
+			return nil, errors.Wrapf(err, "log record %d", i)
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+// msg returns the message of the log record.
+func (rec *otlpRecord) msg() dmon.Msg {
+	m := dmon.Msg{
+		System:    truncate(rec.resource["service.name"], maxSystemLen),
+		Component: truncate(rec.scope, maxComponentLen),
+		Level:     otlpLevel(rec.sevNum, rec.sevText),
+		Message:   truncate(rec.body, maxMessageLen),
+	}
+	if m.System == "" {
+		m.System = "unknown_service"
+	}
+	switch {
+	case rec.time != 0:
+		m.Stamp = time.Unix(0, int64(rec.time)).UTC()
+	case rec.observed != 0:
+		m.Stamp = time.Unix(0, int64(rec.observed)).UTC()
+	}
+	for k, v := range rec.resource {
+		if k != "service.name" {
+			setField(&m, k, v)
+		}
+	}
+	for k, v := range rec.attrs {
+		setField(&m, k, v)
+	}
+	if rec.version != "" {
+		setField(&m, "otel.scope.version", rec.version)
+	}
+	if rec.traceID != "" {
+		setField(&m, "trace_id", rec.traceID)
+	}
+	if rec.spanID != "" {
+		setField(&m, "span_id", rec.spanID)
+	}
+	return m
+}
+
+func setField(m *dmon.Msg, k, v string) {
+	if m.Fields == nil {
+		m.Fields = make(map[string]string)
+	}
+	m.Fields[k] = v
+}
+
+// otlpLevel returns the message level of an OTLP severity.
+func otlpLevel(num int64, text string) string {
+	switch {
+	case num >= 1 && num <= 8:
+		return "debug"
+	case num >= 9 && num <= 12:
+		return "info"
+	case num >= 13 && num <= 16:
+		return "warn"
+	case num >= 17 && num <= 20:
+		return "error"
+	case num >= 21 && num <= 24:
+		return "fatal"
+	}
+	switch t := strings.ToLower(text); {
+	case strings.HasPrefix(t, "trace"), strings.HasPrefix(t, "debug"):
+		return "debug"
+	case strings.HasPrefix(t, "warn"):
+		return "warn"
+	case strings.HasPrefix(t, "err"):
+		return "error"
+	case strings.HasPrefix(t, "fatal"), strings.HasPrefix(t, "crit"):
+		return "fatal"
+	}
+	return "info"
+}
+
+// truncate returns s truncated to max bytes without splitting a UTF-8
+// sequence.
+func truncate(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && s[max]&0xC0 == 0x80 {
+		max--
+	}
+	return s[:max]
+}
+
+// otlpReply sends the status code with msg encoded as the request. Success
+// responses hold an empty ExportLogsServiceResponse, and errors a
+// google.rpc.Status.
+func otlpReply(w http.ResponseWriter, r *http.Request, code int, msg string) {
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct == "application/x-protobuf" {
+		var buf []byte
+		if code >= 300 {
+			buf = appendProtoVarint(buf, 1, uint64(code))
+			buf = appendProtoBytes(buf, 2, []byte(msg))
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(code)
+		w.Write(buf)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if code >= 300 {
+		json.NewEncoder(w).Encode(struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		}{code, msg})
+		return
+	}
+	io.WriteString(w, "{}")
+}
+
+// otlpPartialReply sends an ExportLogsServiceResponse with the number of
+// rejected log records in its partial success.
+func otlpPartialReply(w http.ResponseWriter, r *http.Request, accepted, total int, msg string) {
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	msg = fmt.Sprintf("%s, accepted %d of %d log records", msg, accepted, total)
+	if ct == "application/x-protobuf" {
+		var partial []byte
+		partial = appendProtoVarint(partial, 1, uint64(total-accepted))
+		partial = appendProtoBytes(partial, 2, []byte(msg))
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+		w.Write(appendProtoBytes(nil, 1, partial))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"partialSuccess": map[string]interface{}{
+			"rejectedLogRecords": strconv.Itoa(total - accepted),
+			"errorMessage":       msg,
+		},
+	})
+}
+
+// Protobuf decoding of the OTLP logs messages.
+
+// pbField is a protobuf field.
+type pbField struct {
+	num  int
+	wire int
+	val  uint64 // varint, fixed32 and fixed64 values
+	data []byte // length delimited values
+}
+
+// pbFields returns the fields of the protobuf message data.
+func pbFields(data []byte) ([]pbField, error) {
+	var fs []pbField
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errors.New("invalid field key")
+		}
+		data = data[n:]
+		f := pbField{num: int(key >> 3), wire: int(key & 7)}
+		switch f.wire {
+		case 0:
+			if f.val, n = binary.Uvarint(data); n <= 0 {
+				return nil, errors.New("invalid varint")
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return nil, errors.New("truncated fixed64")
+			}
+			f.val, data = binary.LittleEndian.Uint64(data), data[8:]
+		case 2:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || l > uint64(len(data)-n) {
+				return nil, errors.New("invalid length")
+			}
+			f.data, data = data[n:n+int(l)], data[n+int(l):]
+		case 5:
+			if len(data) < 4 {
+				return nil, errors.New("truncated fixed32")
+			}
+			f.val, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		default:
+			return nil, errors.Errorf("unsupported wire type %d", f.wire)
+		}
+		fs = append(fs, f)
+	}
+	return fs, nil
+}
+
+func appendProtoVarint(buf []byte, num int, v uint64) []byte {
+	buf = binary.AppendUvarint(buf, uint64(num)<<3)
+	return binary.AppendUvarint(buf, v)
+}
+
+func appendProtoBytes(buf []byte, num int, v []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(num)<<3|2)
+	buf = binary.AppendUvarint(buf, uint64(len(v)))
+	return append(buf, v...)
+}
+
+// decodeOTLPProto decodes a protobuf encoded ExportLogsServiceRequest.
+func decodeOTLPProto(data []byte) ([]otlpRecord, error) {
+	var recs []otlpRecord
+	fs, err := pbFields(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fs {
+		if f.num != 1 || f.wire != 2 {
+			continue
+		}
+		// ResourceLogs
+		rfs, err := pbFields(f.data)
+		if err != nil {
+			return nil, errors.Wrap(err, "resource logs")
+		}
+		resource := map[string]string{}
+		for _, rf := range rfs {
+			if rf.num == 1 && rf.wire == 2 {
+				if err = pbAttributes(rf.data, 1, resource); err != nil {
+					return nil, errors.Wrap(err, "resource")
+				}
+			}
+		}
+		for _, rf := range rfs {
+			if rf.num != 2 || rf.wire != 2 {
+				continue
+			}
+			// ScopeLogs
+			sfs, err := pbFields(rf.data)
+			if err != nil {
+				return nil, errors.Wrap(err, "scope logs")
+			}
+			var scope, version string
+			for _, sf := range sfs {
+				if sf.num == 1 && sf.wire == 2 {
+					scope, version, err = pbScope(sf.data)
+					if err != nil {
+						return nil, errors.Wrap(err, "scope")
+					}
+				}
+			}
+			for _, sf := range sfs {
+				if sf.num != 2 || sf.wire != 2 {
+					continue
+				}
+				rec := otlpRecord{resource: resource, scope: scope, version: version}
+				if err = pbLogRecord(sf.data, &rec); err != nil {
+					return nil, errors.Wrap(err, "log record")
+				}
+				recs = append(recs, rec)
+			}
+		}
+	}
+	return recs, nil
+}
+
+// pbScope decodes an InstrumentationScope.
+func pbScope(data []byte) (name, version string, err error) {
+	fs, err := pbFields(data)
+	for _, f := range fs {
+		switch {
+		case f.num == 1 && f.wire == 2:
+			name = string(f.data)
+		case f.num == 2 && f.wire == 2:
+			version = string(f.data)
+		}
+	}
+	return name, version, err
+}
+
+// pbLogRecord decodes a LogRecord.
+func pbLogRecord(data []byte, rec *otlpRecord) error {
+	fs, err := pbFields(data)
+	if err != nil {
+		return err
+	}
+	rec.attrs = map[string]string{}
+	for _, f := range fs {
+		switch {
+		case f.num == 1 && f.wire == 1:
+			rec.time = f.val
+		case f.num == 11 && f.wire == 1:
+			rec.observed = f.val
+		case f.num == 2 && f.wire == 0:
+			rec.sevNum = int64(f.val)
+		case f.num == 3 && f.wire == 2:
+			rec.sevText = string(f.data)
+		case f.num == 5 && f.wire == 2:
+			v, err := pbAnyValue(f.data)
+			if err != nil {
+				return errors.Wrap(err, "body")
+			}
+			rec.body = anyString(v)
+		case f.num == 6 && f.wire == 2:
+			if err = pbAttributes(f.data, -1, rec.attrs); err != nil {
+				return errors.Wrap(err, "attributes")
+			}
+		case f.num == 9 && f.wire == 2 && len(f.data) > 0:
+			rec.traceID = hex.EncodeToString(f.data)
+		case f.num == 10 && f.wire == 2 && len(f.data) > 0:
+			rec.spanID = hex.EncodeToString(f.data)
+		}
+	}
+	return nil
+}
+
+// pbAttributes adds to attrs the KeyValue decoded from data, or from the
+// fields num of data when num is not -1.
+func pbAttributes(data []byte, num int, attrs map[string]string) error {
+	if num < 0 {
+		k, v, err := pbKeyValue(data)
+		if err == nil {
+			attrs[k] = anyString(v)
+		}
+		return err
+	}
+	fs, err := pbFields(data)
+	if err != nil {
+		return err
+	}
+	for _, f := range fs {
+		if f.num == num && f.wire == 2 {
+			if err = pbAttributes(f.data, -1, attrs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pbKeyValue decodes a KeyValue.
+func pbKeyValue(data []byte) (k string, v interface{}, err error) {
+	fs, err := pbFields(data)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, f := range fs {
+		switch {
+		case f.num == 1 && f.wire == 2:
+			k = string(f.data)
+		case f.num == 2 && f.wire == 2:
+			if v, err = pbAnyValue(f.data); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+	return k, v, nil
+}
+
+// pbAnyValue decodes an AnyValue.
+func pbAnyValue(data []byte) (interface{}, error) {
+	fs, err := pbFields(data)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	for _, f := range fs {
+		switch {
+		case f.num == 1 && f.wire == 2:
+			v = string(f.data)
+		case f.num == 2 && f.wire == 0:
+			v = f.val != 0
+		case f.num == 3 && f.wire == 0:
+			v = int64(f.val)
+		case f.num == 4 && f.wire == 1:
+			v = math.Float64frombits(f.val)
+		case f.num == 5 && f.wire == 2:
+			afs, err := pbFields(f.data)
+			if err != nil {
+				return nil, err
+			}
+			a := []interface{}{}
+			for _, af := range afs {
+				if af.num == 1 && af.wire == 2 {
+					e, err := pbAnyValue(af.data)
+					if err != nil {
+						return nil, err
+					}
+					a = append(a, e)
+				}
+			}
+			v = a
+		case f.num == 6 && f.wire == 2:
+			kfs, err := pbFields(f.data)
+			if err != nil {
+				return nil, err
+			}
+			kv := map[string]interface{}{}
+			for _, kf := range kfs {
+				if kf.num == 1 && kf.wire == 2 {
+					k, e, err := pbKeyValue(kf.data)
+					if err != nil {
+						return nil, err
+					}
+					kv[k] = e
+				}
+			}
+			v = kv
+		case f.num == 7 && f.wire == 2:
+			v = append([]byte(nil), f.data...)
+		}
+	}
+	return v, nil
+}
+
+// anyString returns the string representation of an attribute or body value.
+// Strings are returned as is, and arrays and maps in JSON.
+func anyString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// JSON decoding of the OTLP logs messages.
+
+type otlpJSONRequest struct {
+	ResourceLogs []struct {
+		Resource struct {
+			Attributes []otlpJSONKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeLogs []struct {
+			Scope struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			} `json:"scope"`
+			LogRecords []struct {
+				TimeUnixNano         otlpJSONUint       `json:"timeUnixNano"`
+				ObservedTimeUnixNano otlpJSONUint       `json:"observedTimeUnixNano"`
+				SeverityNumber       int64              `json:"severityNumber"`
+				SeverityText         string             `json:"severityText"`
+				Body                 *otlpJSONAnyValue  `json:"body"`
+				Attributes           []otlpJSONKeyValue `json:"attributes"`
+				TraceID              string             `json:"traceId"`
+				SpanID               string             `json:"spanId"`
+			} `json:"logRecords"`
+		} `json:"scopeLogs"`
+	} `json:"resourceLogs"`
+}
+
+type otlpJSONKeyValue struct {
+	Key   string           `json:"key"`
+	Value otlpJSONAnyValue `json:"value"`
+}
+
+type otlpJSONAnyValue struct {
+	StringValue *string       `json:"stringValue"`
+	BoolValue   *bool         `json:"boolValue"`
+	IntValue    *otlpJSONUint `json:"intValue"`
+	DoubleValue *float64      `json:"doubleValue"`
+	ArrayValue  *struct {
+		Values []otlpJSONAnyValue `json:"values"`
+	} `json:"arrayValue"`
+	KvlistValue *struct {
+		Values []otlpJSONKeyValue `json:"values"`
+	} `json:"kvlistValue"`
+	BytesValue *string `json:"bytesValue"`
+}
+
+// otlpJSONUint is a 64 bit integer encoded as a JSON string or number.
+type otlpJSONUint uint64
+
+func (u *otlpJSONUint) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		return nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		uv, uerr := strconv.ParseUint(s, 10, 64)
+		if uerr != nil {
+			return err
+		}
+		v = int64(uv)
+	}
+	*u = otlpJSONUint(v)
+	return nil
+}
+
+// value returns the Go value of v.
+func (v *otlpJSONAnyValue) value() interface{} {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.ArrayValue != nil:
+		a := []interface{}{}
+		for i := range v.ArrayValue.Values {
+			a = append(a, v.ArrayValue.Values[i].value())
+		}
+		return a
+	case v.KvlistValue != nil:
+		kv := map[string]interface{}{}
+		for i := range v.KvlistValue.Values {
+			kv[v.KvlistValue.Values[i].Key] = v.KvlistValue.Values[i].Value.value()
+		}
+		return kv
+	case v.BytesValue != nil:
+		b, _ := base64.StdEncoding.DecodeString(*v.BytesValue)
+		return b
+	}
+	return nil
+}
+
+func otlpJSONAttributes(kvs []otlpJSONKeyValue) map[string]string {
+	attrs := make(map[string]string, len(kvs))
+	for i := range kvs {
+		attrs[kvs[i].Key] = anyString(kvs[i].Value.value())
+	}
+	return attrs
+}
+
+// decodeOTLPJSON decodes a JSON encoded ExportLogsServiceRequest.
+func decodeOTLPJSON(data []byte) ([]otlpRecord, error) {
+	var req otlpJSONRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+	var recs []otlpRecord
+	for _, rl := range req.ResourceLogs {
+		resource := otlpJSONAttributes(rl.Resource.Attributes)
+		for _, sl := range rl.ScopeLogs {
+			for _, lr := range sl.LogRecords {
+				rec := otlpRecord{
+					resource: resource,
+					scope:    sl.Scope.Name,
+					version:  sl.Scope.Version,
+					time:     uint64(lr.TimeUnixNano),
+					observed: uint64(lr.ObservedTimeUnixNano),
+					sevNum:   lr.SeverityNumber,
+					sevText:  lr.SeverityText,
+					attrs:    otlpJSONAttributes(lr.Attributes),
+					traceID:  strings.ToLower(lr.TraceID),
+					spanID:   strings.ToLower(lr.SpanID),
+				}
+				if lr.Body != nil {
+					rec.body = anyString(lr.Body.value())
+				}
+				recs = append(recs, rec)
+			}
+		}
+	}
+	return recs, nil
+}
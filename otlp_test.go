@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chmike/go-dmon/dmon"
+)
+
+// otlpGolden are the messages of the testdata/otlp_logs.* requests.
+var otlpGolden = []dmon.Msg{
+	{
+		Stamp:     time.Unix(0, 1700000000123456789).UTC(),
+		Level:     "error",
+		System:    "checkout",
+		Component: "checkout.api",
+		Message:   "payment failed",
+		Fields: map[string]string{
+			"host.name":          "web-1",
+			"order.id":           "42",
+			"retry":              "true",
+			"latency":            "12.5",
+			"otel.scope.version": "1.2.0",
+			"trace_id":           "5b8efff798038103d269b633813fc60c",
+			"span_id":            "eee19b7ec3c1b174",
+		},
+	},
+	{
+		Stamp:     time.Unix(0, 1700000001000000000).UTC(),
+		Level:     "warn",
+		System:    "checkout",
+		Component: "checkout.api",
+		Message:   `{"code":503}`,
+		Fields: map[string]string{
+			"host.name":          "web-1",
+			"tags":               `["a","b"]`,
+			"payload":            "AQI=",
+			"otel.scope.version": "1.2.0",
+		},
+	},
+	{
+		Stamp:   time.Unix(0, 1700000002000000000).UTC(),
+		Level:   "info",
+		System:  "unknown_service",
+		Message: "hello",
+		Fields:  map[string]string{"deployment": "prod"},
+	},
+}
+
+func TestDecodeOTLPGolden(t *testing.T) {
+	for _, test := range []struct{ file, contentType string }{
+		{"testdata/otlp_logs.pb", "application/x-protobuf"},
+		{"testdata/otlp_logs.json", "application/json; charset=utf-8"},
+	} {
+		data, err := ioutil.ReadFile(test.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "/v1/logs", nil)
+		req.Header.Set("Content-Type", test.contentType)
+		ms, err := decodeOTLP(req, bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: %v", test.file, err)
+			continue
+		}
+		if len(ms) != len(otlpGolden) {
+			t.Errorf("%s: got %d messages, expected %d", test.file, len(ms), len(otlpGolden))
+			continue
+		}
+		for i := range ms {
+			if !reflect.DeepEqual(ms[i].msg, otlpGolden[i]) {
+				t.Errorf("%s: message %d\ngot      %+v\nexpected %+v", test.file, i, ms[i].msg, otlpGolden[i])
+			}
+		}
+	}
+}
+
+func TestDecodeOTLPErrors(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		err         string
+	}{
+		{"text/plain", "", "unsupported content type"},
+		{"application/x-protobuf", "\x0a\x05\x0a", "invalid length"},
+		{"application/x-protobuf", "\x0b", "unsupported wire type 3"},
+		{"application/x-protobuf", "\x0a\x03\x12\x01\x0b", "scope logs: unsupported wire type 3"},
+		{"application/json", `{"resourceLogs": [`, "decode logs"},
+		{"application/json", `{"resourceLogs": [{"scopeLogs": [{"logRecords": [{"timeUnixNano": 1e3}]}]}]}`, "decode logs"},
+		{"application/json", `{"resourceLogs": [{"scopeLogs": [{"logRecords": [{"severityText": "x", "body": {"stringValue": "x"}}]}]}]}`, ""},
+		{"application/json", `{"resourceLogs": [{"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": ""}}]}, "scopeLogs": [{"logRecords": [{}]}]}]}`, ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/v1/logs", nil)
+		req.Header.Set("Content-Type", test.contentType)
+		_, err := decodeOTLP(req, strings.NewReader(test.body))
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s %q: unexpected error %v", test.contentType, test.body, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s %q: got error %v, expected %q", test.contentType, test.body, err, test.err)
+		}
+	}
+}
+
+func TestOTLPRecordMsg(t *testing.T) {
+	long := strings.Repeat("é", maxMessageLen)
+	tests := []struct {
+		name string
+		rec  otlpRecord
+		msg  dmon.Msg
+	}{
+		{
+			"empty",
+			otlpRecord{},
+			dmon.Msg{Level: "info", System: "unknown_service"},
+		},
+		{
+			"resource and record attributes",
+			otlpRecord{
+				resource: map[string]string{"service.name": "api", "host.name": "h1", "env": "prod"},
+				attrs:    map[string]string{"env": "test", "user": "bob"},
+			},
+			dmon.Msg{Level: "info", System: "api", Fields: map[string]string{"host.name": "h1", "env": "test", "user": "bob"}},
+		},
+		{
+			"scope, trace and span",
+			otlpRecord{scope: "db", version: "2.0", traceID: "0102", spanID: "03"},
+			dmon.Msg{Level: "info", System: "unknown_service", Component: "db",
+				Fields: map[string]string{"otel.scope.version": "2.0", "trace_id": "0102", "span_id": "03"}},
+		},
+		{
+			"time before observed time",
+			otlpRecord{time: 2e9, observed: 3e9, sevNum: 5},
+			dmon.Msg{Stamp: time.Unix(2, 0).UTC(), Level: "debug", System: "unknown_service"},
+		},
+		{
+			"observed time",
+			otlpRecord{observed: 3e9, sevText: "CRITICAL"},
+			dmon.Msg{Stamp: time.Unix(3, 0).UTC(), Level: "fatal", System: "unknown_service"},
+		},
+		{
+			"truncated body",
+			otlpRecord{body: long},
+			dmon.Msg{Level: "info", System: "unknown_service", Message: long[:maxMessageLen]},
+		},
+	}
+	for _, test := range tests {
+		if m := test.rec.msg(); !reflect.DeepEqual(m, test.msg) {
+			t.Errorf("%s:\ngot      %+v\nexpected %+v", test.name, m, test.msg)
+		}
+	}
+}
+
+func TestOTLPLevel(t *testing.T) {
+	tests := []struct {
+		num   int64
+		text  string
+		level string
+	}{
+		{1, "", "debug"},
+		{8, "ERROR", "debug"},
+		{9, "", "info"},
+		{13, "", "warn"},
+		{17, "", "error"},
+		{21, "", "fatal"},
+		{0, "Trace", "debug"},
+		{0, "WARNING", "warn"},
+		{0, "err", "error"},
+		{0, "Critical", "fatal"},
+		{0, "notice", "info"},
+		{25, "", "info"},
+	}
+	for _, test := range tests {
+		if l := otlpLevel(test.num, test.text); l != test.level {
+			t.Errorf("%d %q: got %s, expected %s", test.num, test.text, l, test.level)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "net"
+
+// peerCredentials returns nil as peer credentials are only supported on Linux.
+func peerCredentials(conn net.Conn) *peerCred {
+	return nil
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/chmike/go-dmon/dmon"
+	"github.com/pkg/errors"
+)
+
+// The authorization policy, loaded from the -policy JSON file, restricts the
+// messages a client may send according to its certificate identity:
+//
+//	{"rules": [
+//		{"cn": "billing-*", "systems": ["billing"], "components": ["api", "db*"], "max_level": "error"},
+//		{"uri": "spiffe://example.org/ns/web/*", "systems": ["web*"]},
+//		{"ou": "ops"}
+//	]}
+//
+// A rule applies to the clients whose CN, one of the URI SANs and one of the
+// OUs match the patterns given in the rule. A rule without them applies to
+// all the clients, including those without certificate. A message is
+// authorized when a rule applying to its client matches its System and
+// Component, and allows its level. Missing systems or components match any
+// value, and the default max_level is fatal. The patterns are those of
+// path.Match.
+//
+// A rule with "read": true also allows its clients to read the messages of
+// its systems and components, of any level, with a subscription (see tail)
+// or the /v1/recent admin endpoint. With a policy, a client may only read
+// the messages allowed by such a rule, and its subscription or query is
+// rejected when no such rule applies to it.
+//
+// Messages not authorized are rejected with StatusUnauthorized, or dropped
+// when they can't be, and counted by client identity. The policy is reloaded
+// on SIGHUP or when the file is modified. An invalid policy is reported and
+// the previous one is kept.
+
+var statUnauthorized = newStatKeyedCounter("unauthorized")
+
+// policyCheckPeriod is the period of the policy file modification check.
+const policyCheckPeriod = 5 * time.Second
+
+// policy is an authorization policy.
+type policy struct {
+	Rules []policyRule `json:"rules"`
+}
+
+// policyRule is a rule of an authorization policy.
+type policyRule struct {
+	CN         string   `json:"cn"`
+	URI        string   `json:"uri"`
+	OU         string   `json:"ou"`
+	Systems    []string `json:"systems"`
+	Components []string `json:"components"`
+	MaxLevel   string   `json:"max_level"`
+	Read       bool     `json:"read"`
+	maxRank    int
+}
+
+// currentPolicy holds the *policy in force, if any.
+var currentPolicy atomic.Value
+
+// loadPolicy returns the policy read from the file path.
+func loadPolicy(path string) (*policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "load policy")
+	}
+	var p policy
+	if err = json.Unmarshal(data, &p); err != nil {
+		return nil, errors.Wrapf(err, "load policy %s", path)
+	}
+	for i := range p.Rules {
+		if err = p.Rules[i].check(); err != nil {
+			return nil, errors.Wrapf(err, "load policy %s: rule %d", path, i)
+		}
+	}
+	return &p, nil
+}
+
+// check checks the patterns and sets the max level rank of the rule.
+func (r *policyRule) check() error {
+	patterns := append([]string{r.CN, r.URI, r.OU}, r.Systems...)
+	for _, p := range append(patterns, r.Components...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return errors.Errorf("invalid pattern '%s'", p)
+		}
+	}
+	if r.MaxLevel == "" {
+		r.MaxLevel = levels[len(levels)-1]
+	}
+	if r.maxRank = levelRank(r.MaxLevel); r.maxRank < 0 {
+		return errors.Errorf("invalid level '%s'", r.MaxLevel)
+	}
+	return nil
+}
+
+// watchPolicy loads the policy file path, and reloads it on SIGHUP or when
+// it is modified.
+func watchPolicy(path string) error {
+	p, err := loadPolicy(path)
+	if err != nil {
+		return err
+	}
+	currentPolicy.Store(p)
+	log.Printf("policy %s: %d rules", path, len(p.Rules))
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		ticker := time.NewTicker(policyCheckPeriod)
+		mtime := fi.ModTime()
+		for {
+			select {
+			case <-hup:
+			case <-ticker.C:
+				fi, err := os.Stat(path)
+				if err != nil || fi.ModTime().Equal(mtime) {
+					continue
+				}
+				mtime = fi.ModTime()
+			}
+			p, err := loadPolicy(path)
+			if err != nil {
+				log.Printf("%v, keeping the previous policy", err)
+				continue
+			}
+			currentPolicy.Store(p)
+			log.Printf("policy %s reloaded: %d rules", path, len(p.Rules))
+		}
+	}()
+	return nil
+}
+
+// authorize returns an error if the policy in force doesn't allow client to
+// send m. client is nil for a client without certificate.
+func authorize(client *clientID, m *dmon.Msg) error {
+	p, _ := currentPolicy.Load().(*policy)
+	if p == nil {
+		return nil
+	}
+	for i := range p.Rules {
+		if p.Rules[i].allows(client, m) {
+			return nil
+		}
+	}
+	key := client.key()
+	statUnauthorized.inc(key)
+	return errors.Errorf("%s may not send %s messages of system '%s' component '%s'", key, m.Level, m.System, m.Component)
+}
+
+// mayRead returns true if the policy in force allows client to read some
+// messages. client is nil for a client without certificate.
+func mayRead(client *clientID) bool {
+	p, _ := currentPolicy.Load().(*policy)
+	if p == nil {
+		return true
+	}
+	for i := range p.Rules {
+		if p.Rules[i].Read && p.Rules[i].appliesTo(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// readable returns true if the policy in force allows client to read m.
+func readable(client *clientID, m *dmon.Msg) bool {
+	p, _ := currentPolicy.Load().(*policy)
+	if p == nil {
+		return true
+	}
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.Read && r.appliesTo(client) && r.matches(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// key returns the CN of the client, or else its first URI SAN, or else its
+// first OU, identifying it in the stats and the errors. id may be nil.
+func (id *clientID) key() string {
+	switch {
+	case id == nil:
+		return "anonymous"
+	case id.cn != "":
+		return "CN=" + id.cn
+	}
+	for _, san := range id.sans {
+		if strings.HasPrefix(san, "URI:") {
+			return san
+		}
+	}
+	if len(id.ous) != 0 {
+		return "OU=" + id.ous[0]
+	}
+	return "unidentified"
+}
+
+// allows returns true if the rule applies to client and allows m.
+func (r *policyRule) allows(client *clientID, m *dmon.Msg) bool {
+	return r.appliesTo(client) && r.matches(m) && levelRank(m.Level) <= r.maxRank
+}
+
+// appliesTo returns true if the rule applies to client.
+func (r *policyRule) appliesTo(client *clientID) bool {
+	if r.CN == "" && r.URI == "" && r.OU == "" {
+		return true
+	}
+	return client != nil &&
+		(r.CN == "" || match(r.CN, client.cn)) &&
+		(r.URI == "" || matchValues(r.URI, client.sans, "URI:")) &&
+		(r.OU == "" || matchValues(r.OU, client.ous, ""))
+}
+
+// matches returns true if the System and Component of m match the rule.
+func (r *policyRule) matches(m *dmon.Msg) bool {
+	return (len(r.Systems) == 0 || matchPatterns(r.Systems, m.System)) &&
+		(len(r.Components) == 0 || matchPatterns(r.Components, m.Component))
+}
+
+func match(pattern, s string) bool {
+	ok, _ := path.Match(pattern, s)
+	return ok
+}
+
+// matchValues returns true if one of values having the prefix matches
+// pattern once the prefix is removed.
+func matchValues(pattern string, values []string, prefix string) bool {
+	for _, v := range values {
+		if strings.HasPrefix(v, prefix) && match(pattern, v[len(prefix):]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPatterns returns true if s matches one of patterns.
+func matchPatterns(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if match(p, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/chmike/go-dmon/dmon"
+)
+
+func TestPolicyRead(t *testing.T) {
+	defer currentPolicy.Store((*policy)(nil))
+	p := &policy{Rules: []policyRule{
+		{CN: "billing-*", Systems: []string{"billing"}},
+		{OU: "ops", Read: true},
+		{CN: "web", Systems: []string{"web*"}, Read: true},
+	}}
+	for i := range p.Rules {
+		if err := p.Rules[i].check(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	currentPolicy.Store(p)
+	billing := &dmon.Msg{Level: "info", System: "billing", Component: "api"}
+	web := &dmon.Msg{Level: "debug", System: "webshop", Component: "api"}
+	tests := []struct {
+		name         string
+		client       *clientID
+		mayRead      bool
+		billing, web bool
+	}{
+		{"anonymous", nil, false, false, false},
+		{"sender", &clientID{cn: "billing-1"}, false, false, false},
+		{"ops", &clientID{cn: "alice", ous: []string{"ops"}}, true, true, true},
+		{"web", &clientID{cn: "web"}, true, false, true},
+	}
+	for _, test := range tests {
+		if got := mayRead(test.client); got != test.mayRead {
+			t.Errorf("%s: mayRead %v, expected %v", test.name, got, test.mayRead)
+		}
+		if got := readable(test.client, billing); got != test.billing {
+			t.Errorf("%s: readable billing %v, expected %v", test.name, got, test.billing)
+		}
+		if got := readable(test.client, web); got != test.web {
+			t.Errorf("%s: readable web %v, expected %v", test.name, got, test.web)
+		}
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	tests := []struct {
+		client *clientID
+		key    string
+	}{
+		{nil, "anonymous"},
+		{&clientID{cn: "web", sans: []string{"URI:spiffe://a/b"}, ous: []string{"ops"}}, "CN=web"},
+		{&clientID{sans: []string{"DNS:h1", "URI:spiffe://a/b", "URI:spiffe://a/c"}, ous: []string{"ops"}}, "URI:spiffe://a/b"},
+		{&clientID{sans: []string{"DNS:h1"}, ous: []string{"ops", "dev"}}, "OU=ops"},
+		{&clientID{sans: []string{"DNS:h1"}}, "unidentified"},
+	}
+	for _, test := range tests {
+		if key := test.client.key(); key != test.key {
+			t.Errorf("%v: got key %q, expected %q", test.client, key, test.key)
+		}
+	}
+}
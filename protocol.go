@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/chmike/go-dmon/dmon"
+	"github.com/pkg/errors"
+)
+
+// A frame is made of an 8 byte header followed by a payload. The header holds
+// a 4 byte magic identifying the frame type, and the payload length as a
+// little endian uint32.
+const (
+	hdrLen = 8
+	seqLen = 8
+
+	msgMagic    = "DMON" // message, acknowledged with ackCode
+	seqMsgMagic = "DMSQ" // sequence number followed by a message
+	ackMagic    = "DMAK" // highest sequence number processed
+	replyMagic  = "DMRP" // status of a rejected message
+	helloMagic  = "DMHS" // handshake
+	pingMagic   = "DMPI" // heartbeat sent by the client
+	pongMagic   = "DMPO" // heartbeat answer of the server
+	flowMagic   = "DMFC" // delay between messages requested by the server
+	subMagic    = "DMSU" // subscription to the messages matching a filter
+	dropMagic   = "DMDR" // number of messages dropped for a slow subscriber
+)
+
+// protocolVersion is the highest protocol version supported.
+const protocolVersion = 1
+
+// ackCode is the acknowledgment of a msgMagic frame.
+const ackCode byte = 0xA5
+
+// ReplyStatus is the status code carried by a reply frame.
+type ReplyStatus byte
+
+// Reply status codes.
+const (
+	StatusOK ReplyStatus = iota
+	StatusDecodeError
+	StatusTooLarge
+	StatusRateLimited
+	StatusUnauthorized
+	StatusServerBusy
+	StatusRetryAfter
+	StatusUnsupported
+	StatusGoingAway
+	StatusStorageError
+)
+
+var statusNames = [...]string{
+	StatusOK:           "ok",
+	StatusDecodeError:  "decode error",
+	StatusTooLarge:     "too large",
+	StatusRateLimited:  "rate limited",
+	StatusUnauthorized: "unauthorized",
+	StatusServerBusy:   "server busy",
+	StatusRetryAfter:   "retry after",
+	StatusUnsupported:  "unsupported",
+	StatusGoingAway:    "going away",
+	StatusStorageError: "storage error",
+}
+
+func (s ReplyStatus) String() string {
+	if int(s) < len(statusNames) {
+		return statusNames[s]
+	}
+	return fmt.Sprintf("status %d", s)
+}
+
+// Retry returns true when a message rejected with status s may be sent again.
+func (s ReplyStatus) Retry() bool {
+	return s == StatusRateLimited || s == StatusServerBusy || s == StatusRetryAfter || s == StatusStorageError
+}
+
+// ReplyError is a message rejection reported by the server. Seq is the
+// sequence number of the rejected message, or 0 for a msgMagic frame.
+type ReplyError struct {
+	Status     ReplyStatus
+	Seq        uint64
+	RetryAfter time.Duration
+	Reason     string
+}
+
+func (e *ReplyError) Error() string {
+	if e.Reason == "" {
+		return "server replied " + e.Status.String()
+	}
+	return "server replied " + e.Status.String() + ": " + e.Reason
+}
+
+// hello is the payload of the handshake frame opening a connection. It
+// lists the options supported by the client in order of preference.
+type hello struct {
+	Version     int      `json:"version"`
+	Codecs      []string `json:"codecs"`
+	Compression []string `json:"compression,omitempty"`
+	Name        string   `json:"name,omitempty"`
+}
+
+// welcome is the payload of the handshake frame sent back by the server with
+// the chosen options.
+type welcome struct {
+	Version     int    `json:"version"`
+	Codec       string `json:"codec"`
+	Compression string `json:"compression"`
+}
+
+// negotiate returns the options chosen for the client options h. The first
+// option supported by the server is chosen.
+func negotiate(h *hello) (*welcome, error) {
+	if h.Version < 1 {
+		return nil, errors.Errorf("unsupported protocol version %d", h.Version)
+	}
+	w := &welcome{Version: h.Version, Compression: "none"}
+	if w.Version > protocolVersion {
+		w.Version = protocolVersion
+	}
+	for _, c := range h.Codecs {
+		if _, ok := codecs[c]; ok {
+			w.Codec = c
+			break
+		}
+	}
+	if w.Codec == "" {
+		return nil, errors.Errorf("no supported codec in %q", h.Codecs)
+	}
+	for _, c := range h.Compression {
+		if c == "none" || c == "deflate" {
+			w.Compression = c
+			break
+		}
+	}
+	return w, nil
+}
+
+// codec encodes and decodes messages.
+type codec struct {
+	encode func(*dmon.Msg, []byte) ([]byte, error)
+	decode func(*dmon.Msg, []byte) error
+}
+
+var codecs = map[string]codec{
+	"binary": {(*dmon.Msg).BinaryEncode, (*dmon.Msg).BinaryDecode},
+	"json":   {(*dmon.Msg).JSONEncode, (*dmon.Msg).JSONDecode},
+}
+
+// defaultCodec returns the codec used without handshake.
+func defaultCodec() string {
+	if *jsonFlag {
+		return "json"
+	}
+	return "binary"
+}
+
+// compressor compresses message payloads with deflate.
+type compressor struct {
+	buf bytes.Buffer
+	zw  *flate.Writer
+}
+
+// compress appends the compressed data to dst.
+func (c *compressor) compress(dst, data []byte) ([]byte, error) {
+	c.buf.Reset()
+	if c.zw == nil {
+		c.zw, _ = flate.NewWriter(&c.buf, flate.BestSpeed)
+	} else {
+		c.zw.Reset(&c.buf)
+	}
+	if _, err := c.zw.Write(data); err != nil {
+		return dst, errors.Wrap(err, "compress")
+	}
+	if err := c.zw.Close(); err != nil {
+		return dst, errors.Wrap(err, "compress")
+	}
+	return append(dst, c.buf.Bytes()...), nil
+}
+
+// decompressor decompresses message payloads compressed with deflate.
+type decompressor struct {
+	src bytes.Reader
+	buf bytes.Buffer
+	zr  io.ReadCloser
+}
+
+// decompress returns the decompressed data of at most maxLen bytes. It is
+// valid until the next call.
+func (d *decompressor) decompress(data []byte, maxLen int) ([]byte, error) {
+	d.src.Reset(data)
+	if d.zr == nil {
+		d.zr = flate.NewReader(&d.src)
+	} else {
+		d.zr.(flate.Resetter).Reset(&d.src, nil)
+	}
+	d.buf.Reset()
+	n, err := d.buf.ReadFrom(io.LimitReader(d.zr, int64(maxLen)+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "decompress")
+	}
+	if n > int64(maxLen) {
+		return nil, errors.Errorf("decompress: message longer than %d bytes", maxLen)
+	}
+	return d.buf.Bytes(), nil
+}
+
+// maxAckBatch is the maximum number of sequenced messages the server processes
+// before sending a cumulative acknowledgment.
+const maxAckBatch = 64
+
+// Flow control thresholds. The server asks its clients to slow down when the
+// message queue is filled above highWater percent, and to resume when it is
+// below lowWater percent.
+const (
+	highWater     = 75
+	lowWater      = 25
+	slowDownDelay = 100 * time.Microsecond
+	maxPace       = 100 * time.Millisecond
+)
+
+// newFlowFrame returns a flow control frame requesting a delay d between
+// messages. A zero delay resumes the normal rate.
+func newFlowFrame(d time.Duration) []byte {
+	buf := make([]byte, hdrLen+4)
+	binary.LittleEndian.PutUint32(buf[hdrLen:], uint32(d/time.Microsecond))
+	setHeader(buf, flowMagic)
+	return buf
+}
+
+// maxReplyLen is the maximum payload length of a reply frame.
+const maxReplyLen = 1024
+
+// splitAddress returns the network and the address of addr given as
+// network://address. The network is tcp when not specified.
+func splitAddress(addr string) (network, address string) {
+	if i := strings.Index(addr, "://"); i >= 0 {
+		return addr[:i], addr[i+3:]
+	}
+	return "tcp", addr
+}
+
+// setHeader sets the header in front of buf with the frame magic and the
+// length of the payload following it.
+func setHeader(buf []byte, magic string) {
+	copy(buf[:4], magic)
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(buf)-hdrLen))
+}
+
+// readHeader reads a frame header and returns its magic and payload length.
+func readHeader(r *dmon.BufReader, hdr []byte) (string, int, error) {
+	if _, err := r.ReadFull(hdr[:hdrLen]); err != nil {
+		return "", 0, err
+	}
+	return string(hdr[:4]), int(binary.LittleEndian.Uint32(hdr[4:hdrLen])), nil
+}
+
+// newAckFrame returns an ack frame for sequence number seq.
+func newAckFrame(seq uint64) []byte {
+	buf := make([]byte, hdrLen+seqLen)
+	binary.LittleEndian.PutUint64(buf[hdrLen:], seq)
+	setHeader(buf, ackMagic)
+	return buf
+}
+
+// newReplyFrame returns a reply frame holding the rejection e. The payload
+// is the status byte, the sequence number, the retry delay in milliseconds
+// as a uint32, and the reason.
+func newReplyFrame(e *ReplyError) []byte {
+	reason := e.Reason
+	if len(reason) > maxReplyLen-13 {
+		reason = reason[:maxReplyLen-13]
+	}
+	buf := make([]byte, hdrLen+13, hdrLen+13+len(reason))
+	buf[hdrLen] = byte(e.Status)
+	binary.LittleEndian.PutUint64(buf[hdrLen+1:], e.Seq)
+	binary.LittleEndian.PutUint32(buf[hdrLen+9:], uint32(e.RetryAfter/time.Millisecond))
+	buf = append(buf, reason...)
+	setHeader(buf, replyMagic)
+	return buf
+}
+
+// parseReply returns the rejection held in the payload of a reply frame, or
+// nil if the payload is too short.
+func parseReply(buf []byte) *ReplyError {
+	if len(buf) < 13 {
+		return nil
+	}
+	return &ReplyError{
+		Status:     ReplyStatus(buf[0]),
+		Seq:        binary.LittleEndian.Uint64(buf[1:]),
+		RetryAfter: time.Duration(binary.LittleEndian.Uint32(buf[9:])) * time.Millisecond,
+		Reason:     string(buf[13:]),
+	}
+}
+
+// readAck reads an acknowledgment sent by the server. The sequence number is
+// 0 for an ackCode byte. A rejection is returned in the reply field.
+func readAck(r *dmon.BufReader) (a ackInfo) {
+	var hdr [hdrLen]byte
+	b, err := r.ReadByte()
+	if err != nil {
+		return ackInfo{err: err}
+	}
+	if b == ackCode {
+		return a
+	}
+	hdr[0] = b
+	if _, err = r.ReadFull(hdr[1:]); err != nil {
+		return ackInfo{err: err}
+	}
+	magic, dataLen := string(hdr[:4]), int(binary.LittleEndian.Uint32(hdr[4:]))
+	switch {
+	case magic == pongMagic && dataLen == 0:
+		a.pong = true
+	case magic == flowMagic && dataLen == 4:
+		if _, err = r.ReadFull(hdr[:4]); err != nil {
+			return ackInfo{err: err}
+		}
+		a.flow = true
+		a.pace = time.Duration(binary.LittleEndian.Uint32(hdr[:4])) * time.Microsecond
+	case magic == ackMagic && dataLen == seqLen:
+		if _, err = r.ReadFull(hdr[:seqLen]); err != nil {
+			return ackInfo{err: err}
+		}
+		a.seq = binary.LittleEndian.Uint64(hdr[:seqLen])
+	case magic == replyMagic && dataLen >= 13 && dataLen <= maxReplyLen:
+		buf := make([]byte, dataLen)
+		if _, err = r.ReadFull(buf); err != nil {
+			return ackInfo{err: err}
+		}
+		a.reply = parseReply(buf)
+		a.seq = a.reply.Seq
+	default:
+		a.err = errors.Errorf("expected ack byte %+X or ack frame, got %+X", ackCode, hdr[:])
+	}
+	return a
+}
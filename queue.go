@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/chmike/go-dmon/dmon"
+	"github.com/pkg/errors"
+)
+
+// The overload policy, set with -overload, decides what happens to a
+// message when the message queue is full:
+//   - block: wait for room during -queuetimeout, then reject the message,
+//   - drop-newest: drop the message,
+//   - drop-oldest: drop the oldest queued message to make room,
+//   - drop-level: drop debug messages once the queue reaches its high water
+//     mark and info messages when it is full, and block for the others,
+//   - spill: append the message to the spill file, from which the messages
+//     are queued again in order when there is room.
+// A rejected message is answered with StatusServerBusy, and the messages
+// received in datagrams or lines are lost. In durable mode, a dropped
+// message is rejected with StatusStorageError. The messages of the HTTP
+// requests follow the same policy, and the requests are refused with 429
+// above the high water mark of the queue with the block policy.
+
+var (
+	statQueueTimeout = newStatCounter("queue timeout")
+	statDropNewest   = newStatCounter("dropped newest")
+	statDropOldest   = newStatCounter("dropped oldest")
+	statDropDebug    = newStatCounter("dropped debug")
+	statDropInfo     = newStatCounter("dropped info")
+	statSpilled      = newStatCounter("spilled")
+	statReplayed     = newStatCounter("replayed")
+)
+
+var (
+	errQueueTimeout = errors.New("message queue full")
+	errDropped      = errors.New("message dropped by overload policy")
+)
+
+// queueSpill is the spill file of the spill policy.
+var queueSpill *spill
+
+// checkOverload checks the overload policy and opens the spill file of the
+// spill policy, which replays its messages to msgs.
+func checkOverload(msgs chan msgInfo) error {
+	switch *overloadFlag {
+	case "block", "drop-newest", "drop-oldest", "drop-level":
+		return nil
+	case "spill":
+		if *durableFlag != "" {
+			return errors.New("spill policy is incompatible with durable mode")
+		}
+		s, err := openSpill(*spillFlag)
+		if err != nil {
+			return err
+		}
+		queueSpill = s
+		go s.replay(msgs)
+		return nil
+	}
+	return errors.Errorf("invalid overload policy '%s'", *overloadFlag)
+}
+
+// enqueue passes m to msgs, applying the overload policy when msgs is full.
+// It returns errQueueTimeout if m was rejected, and nil if it was queued or
+// dropped. A message not queued is released and its storage result
+// reported.
+func enqueue(msgs chan msgInfo, m msgInfo) error {
+	switch *overloadFlag {
+	case "drop-level":
+		if levelRank(m.msg.Level) == 0 && 100*len(msgs) >= highWater*cap(msgs) {
+			statDropDebug.inc()
+			discard(m, errDropped)
+			return nil
+		}
+	case "spill":
+		if queueSpill.pending() {
+			return spillMsg(msgs, m)
+		}
+	}
+	select {
+	case msgs <- m:
+		return nil
+	default:
+	}
+
+	switch *overloadFlag {
+	case "drop-newest":
+		statDropNewest.inc()
+		discard(m, errDropped)
+		return nil
+	case "drop-oldest":
+		for {
+			select {
+			case msgs <- m:
+				return nil
+			default:
+			}
+			select {
+			case old := <-msgs:
+				statDropOldest.inc()
+				discard(old, errDropped)
+			default:
+			}
+		}
+	case "drop-level":
+		if levelRank(m.msg.Level) <= 1 {
+			statDropInfo.inc()
+			discard(m, errDropped)
+			return nil
+		}
+	case "spill":
+		return spillMsg(msgs, m)
+	}
+	return enqueueWait(msgs, m)
+}
+
+// enqueueWait passes m to msgs, waiting at most -queuetimeout seconds when
+// it is not 0.
+func enqueueWait(msgs chan msgInfo, m msgInfo) error {
+	if *queueTOFlag <= 0 {
+		msgs <- m
+		return nil
+	}
+	timer := time.NewTimer(time.Duration(*queueTOFlag) * time.Second)
+	defer timer.Stop()
+	select {
+	case msgs <- m:
+		return nil
+	case <-timer.C:
+		statQueueTimeout.inc()
+		discard(m, errQueueTimeout)
+		return errQueueTimeout
+	}
+}
+
+// discard releases the message m that was not queued.
+func discard(m msgInfo, err error) {
+	m.commit(err)
+	m.done()
+}
+
+// spillMsg appends m to the spill file, or waits for room in msgs if it
+// fails.
+func spillMsg(msgs chan msgInfo, m msgInfo) error {
+	if err := queueSpill.write(&m); err != nil {
+		log.Println("spill error:", err)
+		return enqueueWait(msgs, m)
+	}
+	statSpilled.inc()
+	m.done()
+	return nil
+}
+
+// spill is a disk queue of messages, as JSON lines appended to a file and
+// read back in order. The file is emptied once all its messages are read,
+// and the unread messages are kept for the next start.
+type spill struct {
+	mtx   sync.Mutex
+	f     *os.File
+	size  int64 // file size
+	read  int64 // offset of the next message to read
+	ready chan struct{}
+}
+
+// spillRecord is a message in the spill file.
+type spillRecord struct {
+	Msg       dmon.Msg `json:"msg"`
+	Peer      []int32  `json:"peer,omitempty"`
+	ClientCN  string   `json:"client_cn,omitempty"`
+	ClientSAN []string `json:"client_san,omitempty"`
+	ClientOU  []string `json:"client_ou,omitempty"`
+}
+
+// openSpill opens the spill file path, whose messages will be read first.
+func openSpill(path string) (*spill, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, errors.Wrap(err, "open spill file")
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "open spill file")
+	}
+	if fi.Size() > 0 {
+		log.Printf("spill file %s: replaying %d bytes", path, fi.Size())
+	}
+	return &spill{f: f, size: fi.Size(), ready: make(chan struct{}, 1)}, nil
+}
+
+// pending returns true when messages are waiting in the spill file.
+func (s *spill) pending() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.read < s.size
+}
+
+// write appends m to the spill file.
+func (s *spill) write(m *msgInfo) error {
+	rec := spillRecord{Msg: m.msg}
+	if m.peer != nil {
+		rec.Peer = []int32{m.peer.pid, m.peer.uid, m.peer.gid}
+	}
+	if m.client != nil {
+		rec.ClientCN, rec.ClientSAN, rec.ClientOU = m.client.cn, m.client.sans, m.client.ous
+	}
+	buf, err := json.Marshal(&rec)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	n, err := s.f.WriteAt(buf, s.size)
+	if err != nil {
+		// overwritten by the next message
+		return err
+	}
+	s.size += int64(n)
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// replay passes the messages of the spill file to msgs, until the server
+// stops. The unread messages are then moved to the start of the file.
+func (s *spill) replay(msgs chan msgInfo) {
+	p := register(nil)
+	if p == nil {
+		return
+	}
+	defer p.done()
+	stop := make(chan struct{})
+	onShutdown(func() { close(stop) })
+	buf := make([]byte, 64*1024)
+	for {
+		s.mtx.Lock()
+		if s.read == s.size && s.size > 0 {
+			s.f.Truncate(0)
+			s.read, s.size = 0, 0
+		}
+		n := s.size - s.read
+		if n > int64(len(buf)) {
+			n = int64(len(buf))
+		}
+		n2, err := s.f.ReadAt(buf[:n], s.read)
+		s.mtx.Unlock()
+		if err != nil && err != io.EOF {
+			log.Println("spill read error:", err)
+		}
+		if n2 == 0 {
+			select {
+			case <-s.ready:
+				continue
+			case <-stop:
+				s.compact()
+				return
+			}
+		}
+
+		// queue the complete lines
+		data := buf[:n2]
+		for {
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			var rec spillRecord
+			if err := json.Unmarshal(data[:i], &rec); err != nil {
+				log.Println("invalid spilled message:", err)
+			} else {
+				m := msgInfo{msg: rec.Msg, len: i + 1}
+				if len(rec.Peer) == 3 {
+					m.peer = &peerCred{pid: rec.Peer[0], uid: rec.Peer[1], gid: rec.Peer[2]}
+				}
+				if rec.ClientCN != "" || len(rec.ClientSAN) != 0 || len(rec.ClientOU) != 0 {
+					m.client = &clientID{cn: rec.ClientCN, ous: rec.ClientOU, sans: rec.ClientSAN}
+				}
+				select {
+				case msgs <- m:
+				case <-stop:
+					s.compact()
+					return
+				}
+				statReplayed.inc()
+			}
+			data = data[i+1:]
+			s.mtx.Lock()
+			s.read += int64(i + 1)
+			s.mtx.Unlock()
+		}
+		switch {
+		case len(data) < n2:
+		case n2 == len(buf):
+			// line longer than buf
+			buf = make([]byte, 2*len(buf))
+		default:
+			// truncated by a crash
+			log.Printf("spill file: skipping %d bytes of a truncated message", n2)
+			s.mtx.Lock()
+			s.read += int64(n2)
+			s.mtx.Unlock()
+		}
+	}
+}
+
+// compact moves the unread messages to the start of the spill file.
+func (s *spill) compact() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	rest := make([]byte, s.size-s.read)
+	if _, err := s.f.ReadAt(rest, s.read); err != nil && err != io.EOF {
+		log.Println("spill compact error:", err)
+		return
+	}
+	s.f.Truncate(0)
+	s.f.WriteAt(rest, 0)
+	s.f.Sync()
+	s.read, s.size = 0, int64(len(rest))
+	if len(rest) > 0 {
+		log.Printf("spill file: %d bytes left for the next start", len(rest))
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/chmike/go-dmon/dmon"
+)
+
+// stalledQueue returns a full message queue of n messages that no sink
+// reads, as with a stalled sink, and the result channel of the oldest one.
+func stalledQueue(n int) (chan msgInfo, chan error) {
+	msgs := make(chan msgInfo, n)
+	oldest := make(chan error, 1)
+	msgs <- msgInfo{msg: dmon.Msg{Level: "error", Message: "queued"}, stored: oldest}
+	for i := 1; i < n; i++ {
+		msgs <- msgInfo{msg: dmon.Msg{Level: "error", Message: "queued"}}
+	}
+	return msgs, oldest
+}
+
+func TestEnqueueStalledSink(t *testing.T) {
+	defer func(p string) { *overloadFlag = p }(*overloadFlag)
+	tests := []struct {
+		policy  string
+		level   string
+		queued  bool   // message is in the queue
+		dropped string // message dropped instead of m, if any
+	}{
+		{"drop-newest", "error", false, "new"},
+		{"drop-oldest", "error", true, "queued"},
+		{"drop-level", "debug", false, "new"},
+		{"drop-level", "info", false, "new"},
+	}
+	for _, test := range tests {
+		*overloadFlag = test.policy
+		msgs, oldest := stalledQueue(4)
+		m := msgInfo{msg: dmon.Msg{Level: test.level, Message: "new"}, stored: make(chan error, 1)}
+		stored := m.stored
+		if err := enqueue(msgs, m); err != nil {
+			t.Errorf("%s %s: unexpected error %v", test.policy, test.level, err)
+			continue
+		}
+		queued := false
+		for len(msgs) > 0 {
+			if q := <-msgs; q.msg.Message == "new" {
+				queued = true
+			}
+		}
+		if queued != test.queued {
+			t.Errorf("%s %s: got queued %v, expected %v", test.policy, test.level, queued, test.queued)
+		}
+		for _, c := range []struct {
+			name   string
+			stored chan error
+		}{{"new", stored}, {"queued", oldest}} {
+			select {
+			case err := <-c.stored:
+				if c.name != test.dropped || err != errDropped {
+					t.Errorf("%s %s: %s message got result %v", test.policy, test.level, c.name, err)
+				}
+			default:
+				if c.name == test.dropped {
+					t.Errorf("%s %s: %s message got no result", test.policy, test.level, c.name)
+				}
+			}
+		}
+	}
+}
+
+func TestEnqueueStalledSinkTimeout(t *testing.T) {
+	defer func(p string, to int) { *overloadFlag, *queueTOFlag = p, to }(*overloadFlag, *queueTOFlag)
+	*overloadFlag, *queueTOFlag = "block", 1
+	msgs, _ := stalledQueue(4)
+	m := msgInfo{msg: dmon.Msg{Level: "error"}, stored: make(chan error, 1)}
+	stored := m.stored
+	if err := enqueue(msgs, m); err != errQueueTimeout {
+		t.Fatalf("got error %v, expected %v", err, errQueueTimeout)
+	}
+	if err := <-stored; err != errQueueTimeout {
+		t.Errorf("got result %v, expected %v", err, errQueueTimeout)
+	}
+}
+
+// TestEnqueueSpill checks that the messages spilled while the queue is full
+// are replayed in order, with their client identity, after a restart.
+func TestEnqueueSpill(t *testing.T) {
+	defer func(p string) { *overloadFlag = p }(*overloadFlag)
+	defer func(s *spill) { queueSpill = s }(queueSpill)
+	*overloadFlag = "spill"
+	path := filepath.Join(t.TempDir(), "spill")
+	s, err := openSpill(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queueSpill = s
+	client := &clientID{cn: "app", ous: []string{"ops", "payments"}, sans: []string{"URI:spiffe://example.org/app"}}
+	msgs, _ := stalledQueue(2)
+	for i := 0; i < 5; i++ {
+		m := msgInfo{msg: dmon.Msg{Level: "info", Message: fmt.Sprint("spilled ", i)}, client: client}
+		if err := enqueue(msgs, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(msgs) != 2 || !s.pending() {
+		t.Fatalf("got %d queued messages, pending %v, expected 2 and spilled messages", len(msgs), s.pending())
+	}
+
+	// restart
+	s.compact()
+	s.f.Close()
+	if s, err = openSpill(path); err != nil {
+		t.Fatal(err)
+	}
+	queueSpill = s
+	msgs = make(chan msgInfo, 10)
+	go s.replay(msgs)
+	for i := 0; i < 5; i++ {
+		select {
+		case m := <-msgs:
+			if text := fmt.Sprint("spilled ", i); m.msg.Message != text {
+				t.Fatalf("got message %q, expected %q", m.msg.Message, text)
+			}
+			if !reflect.DeepEqual(m.client, client) {
+				t.Fatalf("got client %+v, expected %+v", m.client, client)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d replayed messages, expected 5", i)
+		}
+	}
+}
+
+// TestCommitterDropped checks that a message dropped while the previous
+// ones wait to be stored is rejected with its own sequence number.
+func TestCommitterDropped(t *testing.T) {
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	c := newCommitter(srv)
+	stored := make([]chan error, 5)
+	for seq := uint64(1); seq <= 4; seq++ {
+		stored[seq] = c.add(seq, false)
+	}
+	stored[3] <- errDropped
+	stored[1] <- nil
+	stored[2] <- nil
+	stored[4] <- nil
+
+	r := dmon.NewBufReader(cli, 4096)
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	a := readAck(r)
+	if a.err != nil || a.reply != nil || a.seq != 2 {
+		t.Fatalf("got ack %d, reply %v, error %v, expected ack 2", a.seq, a.reply, a.err)
+	}
+	a = readAck(r)
+	if a.err != nil || a.reply == nil || a.reply.Seq != 3 || a.reply.Status != StatusStorageError {
+		t.Fatalf("got ack %d, reply %v, error %v, expected rejection of 3", a.seq, a.reply, a.err)
+	}
+	a = readAck(r)
+	if a.err != nil || a.reply != nil || a.seq != 4 {
+		t.Fatalf("got ack %d, reply %v, error %v, expected ack 4", a.seq, a.reply, a.err)
+	}
+	c.close()
+}
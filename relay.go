@@ -0,0 +1,218 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chmike/go-dmon/dmon"
+	"github.com/pkg/errors"
+)
+
+// The relay sink sends the messages to an upstream dmon server, e.g. to
+// aggregate the messages of the servers of several datacenters. It is a
+// MsgLogSrv client with a handshake and a window of unacknowledged messages.
+// The downstream clients are acknowledged independently of the upstream
+// delivery. While the upstream server is unreachable, up to buffer messages
+// are kept in a backlog, and the oldest are dropped beyond.
+//
+// The relay IDs of the servers a message went through are listed in its
+// relayField. The relay ID defaults to the host name and the -a address,
+// e.g. "web-1/:3000". A message already relayed by this server, or by max_hops
+// servers, is dropped to break loops.
+
+const (
+	relayField         = "dmon_relay"
+	defaultRelayWindow = 100
+	defaultRelayHops   = 8
+	relayRetryDelay    = 2 * time.Second
+)
+
+var statRelayLoop = newStatCounter("relay loop")
+
+// relaySink sends the messages to an upstream server.
+type relaySink struct {
+	conf    *sinkConfig
+	lms     *MsgLogSrv
+	backlog msgRing
+	retry   time.Time // time of the next connection attempt
+	err     error
+}
+
+func newRelaySink(c *sinkConfig) (Sink, error) {
+	if c.Address == "" {
+		return nil, errors.New("missing address")
+	}
+	if c.Window <= 0 {
+		c.Window = defaultRelayWindow
+	}
+	if c.MaxHops <= 0 {
+		c.MaxHops = defaultRelayHops
+	}
+	if c.RelayID == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, errors.Wrap(err, "relay id")
+		}
+		c.RelayID = host + "/" + *addressFlag
+	}
+	if strings.Contains(c.RelayID, ",") {
+		return nil, errors.Errorf("invalid relay id '%s'", c.RelayID)
+	}
+	s := &relaySink{
+		conf:    c,
+		backlog: msgRing{buf: make([]dmon.Msg, c.Buffer)},
+		lms: &MsgLogSrv{
+			Address:   c.Address,
+			Window:    c.Window,
+			Handshake: true,
+			Name:      "relay " + c.RelayID,
+			Codecs:    []string{"binary", "json"},
+			Heartbeat: time.Duration(*heartbeatFlag) * time.Second,
+			TLS:       c.TLS,
+		},
+	}
+	if c.Compress {
+		s.lms.Compression = []string{"deflate", "none"}
+	}
+	return s, nil
+}
+
+// relayed returns a copy of m with the relay ID appended to its relay
+// path, or false if m must not be relayed.
+func (s *relaySink) relayed(m *dmon.Msg) (dmon.Msg, bool) {
+	r := *m
+	var path []string
+	if p := m.Fields[relayField]; p != "" {
+		path = strings.Split(p, ",")
+	}
+	if len(path) >= s.conf.MaxHops {
+		return r, false
+	}
+	for _, id := range path {
+		if id == s.conf.RelayID {
+			return r, false
+		}
+	}
+	r.Fields = make(map[string]string, len(m.Fields)+1)
+	for k, v := range m.Fields {
+		r.Fields[k] = v
+	}
+	r.Fields[relayField] = strings.Join(append(path, s.conf.RelayID), ",")
+	return r, true
+}
+
+func (s *relaySink) Write(ms []msgInfo) error {
+	for i := range ms {
+		r, ok := s.relayed(&ms[i].msg)
+		if !ok {
+			statRelayLoop.inc()
+			ms[i].commit(nil)
+			continue
+		}
+		if !s.backlog.push(r) {
+			statSinkDropped.inc(s.conf.Name)
+		}
+		ms[i].commit(nil)
+	}
+	if s.lms.conn == nil && time.Now().Before(s.retry) {
+		return s.err
+	}
+	return s.send()
+}
+
+// send sends the messages of the backlog until it is empty or the upstream
+// server fails.
+func (s *relaySink) send() error {
+	for s.backlog.n > 0 {
+		seq := s.lms.seq
+		s.lms.SendMessage(s.backlog.front())
+		err := s.lms.Error()
+		if _, ok := err.(*ReplyError); ok {
+			// the rejected message is dropped
+			log.Printf("sink %s: %v", s.conf.Name, err)
+			err = nil
+		}
+		if err == nil || s.lms.seq != seq {
+			// the message was sent, and is sent again after a reconnect
+			// when not acknowledged
+			s.backlog.pop()
+		}
+		if err != nil {
+			return s.fail(err)
+		}
+	}
+	s.err = nil
+	return nil
+}
+
+// fail records the error err of the upstream server, and delays the next
+// connection attempt.
+func (s *relaySink) fail(err error) error {
+	s.err = errors.Wrap(err, "relay")
+	s.retry = time.Now().Add(relayRetryDelay)
+	return s.err
+}
+
+func (s *relaySink) Flush() error {
+	if s.lms.conn == nil {
+		return nil
+	}
+	err := s.lms.Flush()
+	if _, ok := err.(*ReplyError); ok {
+		log.Printf("sink %s: %v", s.conf.Name, err)
+		err = nil
+	}
+	if err != nil {
+		return s.fail(err)
+	}
+	return nil
+}
+
+func (s *relaySink) Close() error {
+	err := s.send()
+	if err == nil && len(s.lms.pending) > 0 {
+		err = s.Flush()
+	}
+	if n := s.backlog.n + len(s.lms.pending); n > 0 {
+		log.Printf("sink %s: %d messages not relayed", s.conf.Name, n)
+	}
+	s.lms.Close()
+	return err
+}
+
+func (s *relaySink) Health() error {
+	return s.err
+}
+
+// msgRing is a FIFO of at most len(buf) messages.
+type msgRing struct {
+	buf  []dmon.Msg
+	head int // index of the oldest message
+	n    int // number of messages
+}
+
+// push appends m, and returns false if the oldest message was dropped to
+// make room.
+func (q *msgRing) push(m dmon.Msg) bool {
+	full := q.n == len(q.buf)
+	if full {
+		q.pop()
+	}
+	q.buf[(q.head+q.n)%len(q.buf)] = m
+	q.n++
+	return !full
+}
+
+// front returns the oldest message. The ring must not be empty.
+func (q *msgRing) front() *dmon.Msg {
+	return &q.buf[q.head]
+}
+
+// pop removes the oldest message. The ring must not be empty.
+func (q *msgRing) pop() {
+	q.buf[q.head] = dmon.Msg{}
+	q.head = (q.head + 1) % len(q.buf)
+	q.n--
+}
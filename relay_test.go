@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/chmike/go-dmon/dmon"
+)
+
+func TestMsgRing(t *testing.T) {
+	q := msgRing{buf: make([]dmon.Msg, 3)}
+	dropped := 0
+	for i := 0; i < 5; i++ {
+		if !q.push(dmon.Msg{Message: strconv.Itoa(i)}) {
+			dropped++
+		}
+		if i == 2 {
+			// pop one message to wrap around
+			if q.front().Message != "0" {
+				t.Fatalf("got front %q, expected 0", q.front().Message)
+			}
+			q.pop()
+		}
+	}
+	if dropped != 1 || q.n != 3 {
+		t.Fatalf("got %d dropped and %d messages, expected 1 and 3", dropped, q.n)
+	}
+	for _, expected := range []string{"2", "3", "4"} {
+		if m := q.front().Message; m != expected {
+			t.Errorf("got %q, expected %q", m, expected)
+		}
+		q.pop()
+	}
+}
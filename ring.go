@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chmike/go-dmon/dmon"
+	"github.com/chmike/go-dmon/filter"
+	"github.com/pkg/errors"
+)
+
+// The ring sink keeps the last size messages received, or those received
+// during the last max_age, in memory. Without -config nor -db, the server
+// uses a ring sink with the default size. The messages are queried with a
+// GET request on /v1/recent on the -admin HTTP address, with the optional
+// parameters
+//
+//	since, until  RFC 3339 time, or duration before now (e.g. 5m), of the
+//	              message stamps
+//	level         minimum level
+//	system        system pattern
+//	component     component pattern
+//	filter        filter expression (see package filter)
+//	limit         max number of messages, the most recent (default 100)
+//
+// The messages are returned in reception order, e.g.
+//
+//	curl 'localhost:8081/v1/recent?since=10m&level=warn&system=billing'
+//
+// The admin endpoints use TLS with client certificates with -tls. With a
+// -policy, a query only returns the messages the client may read, and is
+// refused when it may read none (see policy).
+//
+// The sink adds each batch with one lock, and the queries only hold the
+// lock to copy chunks of entries, which are matched once it is released.
+
+const (
+	defaultRingSize  = 10000
+	defaultRingLimit = 100
+	ringQueryChunk   = 256 // entries copied with one lock by a query
+)
+
+// recent is the ring of the ring sink, if any.
+var recent *ring
+
+// ringEntry is a message with its reception time.
+type ringEntry struct {
+	recv time.Time
+	msg  dmon.Msg
+}
+
+// ring is a circular buffer of the last messages.
+type ring struct {
+	mtx    sync.RWMutex
+	buf    []ringEntry
+	next   int    // index of the next entry
+	n      int    // number of entries
+	total  uint64 // number of entries written
+	maxAge time.Duration
+}
+
+func newRingSink(c *sinkConfig) (Sink, error) {
+	if recent != nil {
+		return nil, errors.New("only one ring sink is supported")
+	}
+	if c.Size <= 0 {
+		c.Size = defaultRingSize
+	}
+	r := &ring{buf: make([]ringEntry, c.Size)}
+	if c.MaxAge != "" {
+		var err error
+		if r.maxAge, err = time.ParseDuration(c.MaxAge); err != nil || r.maxAge <= 0 {
+			return nil, errors.Errorf("invalid max age '%s'", c.MaxAge)
+		}
+	}
+	recent = r
+	return r, nil
+}
+
+// oldest returns the index of the oldest entry.
+func (r *ring) oldest() int {
+	return (r.next - r.n + len(r.buf)) % len(r.buf)
+}
+
+// expire removes the entries older than maxAge. The mutex must be locked.
+func (r *ring) expire(now time.Time) {
+	if r.maxAge == 0 {
+		return
+	}
+	limit := now.Add(-r.maxAge)
+	for r.n > 0 && r.buf[r.oldest()].recv.Before(limit) {
+		r.buf[r.oldest()] = ringEntry{}
+		r.n--
+	}
+}
+
+func (r *ring) Write(ms []msgInfo) error {
+	now := time.Now()
+	r.mtx.Lock()
+	for i := range ms {
+		r.buf[r.next] = ringEntry{recv: now, msg: ms[i].msg}
+		if r.next++; r.next == len(r.buf) {
+			r.next = 0
+		}
+		if r.n < len(r.buf) {
+			r.n++
+		}
+		r.total++
+	}
+	r.expire(now)
+	r.mtx.Unlock()
+	for i := range ms {
+		ms[i].commit(nil)
+	}
+	return nil
+}
+
+func (r *ring) Flush() error  { return nil }
+func (r *ring) Close() error  { return nil }
+func (r *ring) Health() error { return nil }
+
+// ringQuery selects messages of the ring.
+type ringQuery struct {
+	since, until time.Time
+	minRank      int
+	system       string
+	component    string
+	filter       *filter.Filter
+	limit        int
+	client       *clientID
+}
+
+// match returns true if m is selected by q.
+func (q *ringQuery) match(m *dmon.Msg) bool {
+	return !m.Stamp.Before(q.since) &&
+		(q.until.IsZero() || !m.Stamp.After(q.until)) &&
+		levelRank(m.Level) >= q.minRank &&
+		(q.system == "" || match(q.system, m.System)) &&
+		(q.component == "" || match(q.component, m.Component)) &&
+		(q.filter == nil || q.filter.Match(m)) &&
+		readable(q.client, m)
+}
+
+// query returns the last q.limit messages matching q in reception order,
+// and true if older matching messages were left out.
+func (r *ring) query(q *ringQuery) ([]dmon.Msg, bool) {
+	var ms []dmon.Msg
+	limit := time.Time{}
+	if r.maxAge > 0 {
+		limit = time.Now().Add(-r.maxAge)
+	}
+	chunk := make([]ringEntry, 0, ringQueryChunk)
+	r.mtx.RLock()
+	end := r.total // entries before end are left to match
+	r.mtx.RUnlock()
+	for {
+		// copy the previous entries still in the ring, newest first
+		chunk = chunk[:0]
+		r.mtx.RLock()
+		for start := r.total - uint64(r.n); end > start && len(chunk) < cap(chunk); {
+			end--
+			chunk = append(chunk, r.buf[end%uint64(len(r.buf))])
+		}
+		r.mtx.RUnlock()
+		if len(chunk) == 0 {
+			break
+		}
+		for i := range chunk {
+			e := &chunk[i]
+			if e.recv.Before(limit) {
+				return reverse(ms), false
+			}
+			if !q.match(&e.msg) {
+				continue
+			}
+			if len(ms) == q.limit {
+				return reverse(ms), true
+			}
+			ms = append(ms, e.msg)
+		}
+	}
+	return reverse(ms), false
+}
+
+// reverse reverses the order of ms and returns it.
+func reverse(ms []dmon.Msg) []dmon.Msg {
+	for i, j := 0, len(ms)-1; i < j; i, j = i+1, j-1 {
+		ms[i], ms[j] = ms[j], ms[i]
+	}
+	return ms
+}
+
+// parseRingQuery returns the query of the parameters of request req.
+func parseRingQuery(req *http.Request) (*ringQuery, error) {
+	p := req.URL.Query()
+	q := &ringQuery{limit: defaultRingLimit}
+	var err error
+	now := time.Now()
+	if q.since, err = parseQueryTime(p.Get("since"), now); err != nil {
+		return nil, errors.Wrap(err, "since")
+	}
+	if q.until, err = parseQueryTime(p.Get("until"), now); err != nil {
+		return nil, errors.Wrap(err, "until")
+	}
+	if l := p.Get("level"); l != "" {
+		if q.minRank = levelRank(l); q.minRank < 0 {
+			return nil, errors.Errorf("invalid level '%s'", l)
+		}
+	}
+	q.system, q.component = p.Get("system"), p.Get("component")
+	for _, pattern := range []string{q.system, q.component} {
+		if _, err = path.Match(pattern, ""); err != nil {
+			return nil, errors.Errorf("invalid pattern '%s'", pattern)
+		}
+	}
+	if f := p.Get("filter"); f != "" {
+		if q.filter, err = filter.Compile(f); err != nil {
+			return nil, errors.Wrap(err, "filter")
+		}
+	}
+	if l := p.Get("limit"); l != "" {
+		if q.limit, err = strconv.Atoi(l); err != nil || q.limit <= 0 {
+			return nil, errors.Errorf("invalid limit '%s'", l)
+		}
+	}
+	return q, nil
+}
+
+// parseQueryTime returns the time s, in RFC 3339 format or as a duration
+// before now, or the zero time if s is empty.
+func parseQueryTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return t, errors.Errorf("invalid time '%s'", s)
+	}
+	return t, nil
+}
+
+// serveRecent answers the queries of the recent messages.
+func serveRecent(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		jsonReply(w, req, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if recent == nil {
+		jsonReply(w, req, http.StatusNotFound, "no ring sink")
+		return
+	}
+	var client *clientID
+	if req.TLS != nil {
+		client = certIdentity(req.TLS.PeerCertificates)
+	}
+	if !mayRead(client) {
+		jsonReply(w, req, http.StatusForbidden, "client may not read messages")
+		return
+	}
+	q, err := parseRingQuery(req)
+	if err != nil {
+		jsonReply(w, req, http.StatusBadRequest, err.Error())
+		return
+	}
+	q.client = client
+	ms, truncated := recent.query(q)
+	if ms == nil {
+		ms = []dmon.Msg{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Messages  []dmon.Msg `json:"messages"`
+		Truncated bool       `json:"truncated"`
+	}{ms, truncated})
+}
+
+// listenAdmin serves the admin endpoints on address.
+func listenAdmin(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/recent", serveRecent)
+	srv := &http.Server{Addr: address, Handler: mux}
+	log.Println("listen admin:", address)
+	if !*tlsFlag && *policyFlag == "" {
+		log.Println("warning: admin endpoints served without authentication nor policy")
+	}
+	onShutdown(func() { srv.Close() })
+	if err := serveHTTP(srv); err != http.ErrServerClosed {
+		log.Fatalln("failed listen admin:", err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/chmike/go-dmon/dmon"
+)
+
+func TestRingQuery(t *testing.T) {
+	r := &ring{buf: make([]ringEntry, 700)}
+	for i := 0; i < 2000; i += 100 {
+		ms := make([]msgInfo, 100)
+		for j := range ms {
+			ms[j].msg = dmon.Msg{Level: "info", System: "s" + strconv.Itoa((i+j)%3), Message: strconv.Itoa(i + j)}
+		}
+		r.Write(ms)
+	}
+	tests := []struct {
+		system      string
+		limit       int
+		first, last int // first and last message numbers
+		n           int
+		truncated   bool
+	}{
+		{"", 1000, 1300, 1999, 700, false},
+		{"", 10, 1990, 1999, 10, true},
+		{"s1", 1000, 1300, 1999, 234, false},
+		{"s1", 200, 1402, 1999, 200, true},
+		{"none", 10, 0, 0, 0, false},
+	}
+	for _, test := range tests {
+		ms, truncated := r.query(&ringQuery{system: test.system, limit: test.limit})
+		if len(ms) != test.n || truncated != test.truncated {
+			t.Errorf("%q %d: got %d messages truncated %v, expected %d truncated %v",
+				test.system, test.limit, len(ms), truncated, test.n, test.truncated)
+			continue
+		}
+		if len(ms) == 0 {
+			continue
+		}
+		if ms[0].Message != strconv.Itoa(test.first) || ms[len(ms)-1].Message != strconv.Itoa(test.last) {
+			t.Errorf("%q %d: got messages %s to %s, expected %d to %d", test.system, test.limit,
+				ms[0].Message, ms[len(ms)-1].Message, test.first, test.last)
+		}
+	}
+}
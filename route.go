@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/chmike/go-dmon/dmon"
+	"github.com/chmike/go-dmon/filter"
+	"github.com/pkg/errors"
+)
+
+// The routes of the -config file select the sinks of each message, e.g.
+//
+//	"routes": [
+//		{"systems": ["payments"], "levels": ["error"], "sinks": ["db", "hook"], "continue": true},
+//		{"levels": ["debug"], "sinks": ["log"]},
+//		{"filter": "num(fields.latency) > 500", "sinks": ["db", "hook"]},
+//		{"sinks": ["db", "log"]}
+//	]
+//
+// The routes are evaluated in order. A route matches a message when each of
+// its non empty levels, systems and components lists has a pattern matching
+// the corresponding message field, and its message regular expression, if
+// any, matches the message text, and its filter expression, if any, is
+// true (see package filter). The message is delivered to the sinks of
+// the matching routes, and the evaluation stops at the first matching route
+// without continue. A message matching no route is dropped. Without routes,
+// the messages are delivered to all the sinks.
+//
+// With -durable db, only the messages delivered to the first mysql sink are
+// acknowledged. The others, matching no route or routed away from it, are
+// rejected with a storage error, so that the routes of a durable server
+// should deliver every message to that sink.
+//
+// The routes can be tested offline with "dmon -config file route-test
+// [file ...]", which prints the sinks of each NDJSON message read from the
+// files or the standard input.
+
+var statUnrouted = newStatCounter("unrouted")
+
+// routeConfig is the configuration of a route.
+type routeConfig struct {
+	Levels     []string `json:"levels"`
+	Systems    []string `json:"systems"`
+	Components []string `json:"components"`
+	Message    string   `json:"message"` // regular expression
+	Filter     string   `json:"filter"`  // filter expression
+	Sinks      []string `json:"sinks"`
+	Continue   bool     `json:"continue"`
+}
+
+// route is a compiled route.
+type route struct {
+	routeConfig
+	re    *regexp.Regexp
+	f     *filter.Filter
+	sinks []int // indexes of the sinks in the configuration
+}
+
+// router selects the sinks of the messages.
+type router struct {
+	routes []route
+	dest   []bool
+}
+
+// newRouter returns the router of the routes of configuration c, or nil
+// when c has no routes.
+func newRouter(c *config) (*router, error) {
+	if len(c.Routes) == 0 {
+		return nil, nil
+	}
+	index := make(map[string]int)
+	for i, sc := range c.Sinks {
+		if sc.Name == "" {
+			sc.Name = sc.Type
+		}
+		index[sc.Name] = i
+	}
+	rt := &router{dest: make([]bool, len(c.Sinks))}
+	for i, rc := range c.Routes {
+		r := route{routeConfig: rc}
+		if len(rc.Sinks) == 0 {
+			return nil, errors.Errorf("route %d: no sinks", i+1)
+		}
+		for _, name := range rc.Sinks {
+			j, ok := index[name]
+			if !ok {
+				return nil, errors.Errorf("route %d: unknown sink '%s'", i+1, name)
+			}
+			r.sinks = append(r.sinks, j)
+		}
+		for _, p := range append(append(rc.Levels, rc.Systems...), rc.Components...) {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, errors.Errorf("route %d: invalid pattern '%s'", i+1, p)
+			}
+		}
+		if rc.Message != "" {
+			var err error
+			if r.re, err = regexp.Compile(rc.Message); err != nil {
+				return nil, errors.Wrapf(err, "route %d", i+1)
+			}
+		}
+		if rc.Filter != "" {
+			var err error
+			if r.f, err = filter.Compile(rc.Filter); err != nil {
+				return nil, errors.Wrapf(err, "route %d: filter", i+1)
+			}
+		}
+		rt.routes = append(rt.routes, r)
+	}
+	return rt, nil
+}
+
+// match returns true if the route matches message m.
+func (r *route) match(m *dmon.Msg) bool {
+	return (len(r.Levels) == 0 || matchPatterns(r.Levels, m.Level)) &&
+		(len(r.Systems) == 0 || matchPatterns(r.Systems, m.System)) &&
+		(len(r.Components) == 0 || matchPatterns(r.Components, m.Component)) &&
+		(r.re == nil || r.re.MatchString(m.Message)) &&
+		(r.f == nil || r.f.Match(m))
+}
+
+// route returns the destination flags of message m indexed like the sinks,
+// and the number of the matching routes starting from 1. The returned
+// slice is reused by the next call.
+func (rt *router) route(m *dmon.Msg) ([]bool, []int) {
+	for i := range rt.dest {
+		rt.dest[i] = false
+	}
+	var matched []int
+	for i := range rt.routes {
+		r := &rt.routes[i]
+		if !r.match(m) {
+			continue
+		}
+		matched = append(matched, i+1)
+		for _, j := range r.sinks {
+			rt.dest[j] = true
+		}
+		if !r.Continue {
+			break
+		}
+	}
+	return rt.dest, matched
+}
+
+// routeTest prints the sinks selected by the routes of the -config file
+// for each NDJSON message read from the files, or the standard input.
+func routeTest(files []string) {
+	log.SetPrefix("route-test ")
+	if *configFlag == "" {
+		log.Fatal("route-test requires -config")
+	}
+	c, err := loadConfig(*configFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rt, err := newRouter(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, name := range files {
+		in := io.Reader(os.Stdin)
+		if name != "-" {
+			f, err := os.Open(name)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			in = f
+		}
+		s := bufio.NewScanner(in)
+		s.Buffer(nil, 1<<20)
+		for line := 1; s.Scan(); line++ {
+			if strings.TrimSpace(s.Text()) == "" {
+				continue
+			}
+			var m dmon.Msg
+			if err := json.Unmarshal(s.Bytes(), &m); err != nil {
+				fmt.Printf("%s:%d: invalid message: %v\n", name, line, err)
+				continue
+			}
+			fmt.Printf("%s:%d: %s %s %s %q -> %s\n", name, line, m.Level, m.System,
+				m.Component, m.Message, routeDescr(c, rt, &m))
+		}
+		if err := s.Err(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// routeDescr returns the sinks and the routes of message m.
+func routeDescr(c *config, rt *router, m *dmon.Msg) string {
+	if rt == nil {
+		return "all sinks (no routes)"
+	}
+	dest, matched := rt.route(m)
+	var sinks []string
+	for i, ok := range dest {
+		if ok {
+			name := c.Sinks[i].Name
+			if name == "" {
+				name = c.Sinks[i].Type
+			}
+			sinks = append(sinks, name)
+		}
+	}
+	if len(sinks) == 0 {
+		return "dropped (no route)"
+	}
+	routes := make([]string, len(matched))
+	for i, n := range matched {
+		routes[i] = strconv.Itoa(n)
+	}
+	return fmt.Sprintf("%s (routes %s)", strings.Join(sinks, ", "), strings.Join(routes, ", "))
+}
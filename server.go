@@ -5,123 +5,547 @@ import (
 	"crypto/tls"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"log"
 	"net"
+	"os"
+	"sync/atomic"
 	"time"
 
 	"github.com/chmike/go-dmon/dmon"
+	"github.com/pkg/errors"
 )
 
-const ackCode byte = 0xA5
-
 type msgInfo struct {
-	len int
-	msg dmon.Msg
+	len    int
+	msg    dmon.Msg
+	budget *budget
+	peer   *peerCred
+	client *clientID
+	stored chan error // receives the storage result in durable mode
+	refs   *int32     // number of sinks processing the message, if several
 }
 
+// done releases the resources held by the message once it is processed, by
+// all the sinks when it is shared.
+func (m *msgInfo) done() {
+	if m.refs != nil && atomic.AddInt32(m.refs, -1) > 0 {
+		return
+	}
+	m.budget.release(m.len)
+}
+
+// commit reports the storage result of the message in durable mode. Only
+// the first result is reported.
+func (m *msgInfo) commit(err error) {
+	if m.stored != nil {
+		m.stored <- err
+		m.stored = nil
+	}
+}
+
+// skipMessage reads the sequence number of a seqMsgMagic frame payload of
+// dataLen bytes from r and skips the message.
+func skipMessage(conn net.Conn, r *dmon.BufReader, dataLen int) (uint64, error) {
+	buf := make([]byte, 32*1024)
+	conn.SetReadDeadline(time.Now().Add(timeOutDelay))
+	if _, err := r.ReadFull(buf[:seqLen]); err != nil {
+		return 0, err
+	}
+	seq := binary.LittleEndian.Uint64(buf[:seqLen])
+	for n := dataLen - seqLen; n > 0; {
+		if n < len(buf) {
+			buf = buf[:n]
+		}
+		conn.SetReadDeadline(time.Now().Add(timeOutDelay))
+		if _, err := r.ReadFull(buf); err != nil {
+			return 0, err
+		}
+		n -= len(buf)
+	}
+	return seq, nil
+}
+
+// budgetRetryDelay is the delay requested to a client exceeding its memory
+// budget before sending the message again.
+const budgetRetryDelay = 100 * time.Millisecond
+
 func runAsServer() {
 	log.SetPrefix("server ")
 
+	conf, err := loadConfig(*configFlag)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	sinks, err := newSinks(conf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	rt, err := newRouter(conf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
 	msgs := make(chan msgInfo, *dbBufLenFlag*10)
-	defer close(msgs)
-	go database(msgs)
+	sinkMsgs := msgs
+	switch *durableFlag {
+	case "", "db":
+	case "journal":
+		sinkMsgs = make(chan msgInfo, cap(msgs))
+		go journal(*journalFlag, msgs, sinkMsgs)
+	default:
+		log.Fatalf("invalid durable mode '%s'", *durableFlag)
+	}
+	sinksDone := make(chan error, 1)
+	go func() {
+		sinksDone <- fanOut(sinkMsgs, sinks, rt)
+	}()
+	if err := checkOverload(msgs); err != nil {
+		log.Fatalln(err)
+	}
+	if *policyFlag != "" {
+		if err := watchPolicy(*policyFlag); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *udpFlag != "" {
+		go listenUDP(*udpFlag, msgs)
+	}
 
-	var (
-		listener net.Listener
-		err      error
-	)
-	// listen for a connection
-	if *tlsFlag {
-		var serverCert tls.Certificate
-		serverCert, err = tls.LoadX509KeyPair(serverCRTFilename, serverKeyFilename)
+	listener, err := listenTCP(*addressFlag)
+	if err != nil {
+		log.Fatalln("failed listen:", err)
+	}
+	log.Println("listen:", *addressFlag)
+
+	limiter := newConnLimiter(*maxConnFlag, *maxConnIPFlag)
+	if *adminFlag != "" {
+		go listenAdmin(*adminFlag)
+	}
+	if *httpFlag != "" {
+		go listenHTTP(*httpFlag, msgs, limiter)
+	}
+	if *unixFlag != "" {
+		unixListener, err := listenUnix(*unixFlag, *unixModeFlag, *unixOwnerFlag)
 		if err != nil {
-			log.Fatal(err)
+			log.Fatalln("failed listen unix:", err)
 		}
-
-		config := tls.Config{
-			Certificates: []tls.Certificate{serverCert},
-			ClientAuth:   tls.RequireAndVerifyClientCert,
-			ClientCAs:    certPool,
+		defer os.Remove(*unixFlag)
+		go serve(unixListener, msgs, limiter, handleClient)
+	}
+	if *forwardFlag != "" {
+		forwardListener, err := listenTCP(*forwardFlag)
+		if err != nil {
+			log.Fatalln("failed listen forward:", err)
 		}
-		config.Rand = rand.Reader
-		listener, err = tls.Listen("tcp", *addressFlag, &config)
+		log.Println("listen forward:", *forwardFlag)
+		go serve(forwardListener, msgs, limiter, handleForward)
+	}
+	if *lineFlag != "" {
+		format, err := newLineFormat(*lineFormatFlag, *lineTemplFlag)
+		if err != nil {
+			log.Fatalln("invalid line format:", err)
+		}
+		lineListener, err := listenTCP(*lineFlag)
 		if err != nil {
-			log.Fatalln("failed listen:", err)
+			log.Fatalln("failed listen line:", err)
 		}
-	} else {
-		listener, err = net.Listen("tcp", *addressFlag)
+		log.Println("listen line:", *lineFlag)
+		go serve(lineListener, msgs, limiter, format.handle)
 	}
+	go serve(listener, msgs, limiter, handleClient)
+	waitShutdown(msgs, sinksDone)
+}
 
-	log.Println("listen:", *addressFlag)
+// listenTCP returns a TCP listener on address, with TLS when -tls is set.
+func listenTCP(address string) (net.Listener, error) {
+	if !*tlsFlag {
+		return net.Listen("tcp", address)
+	}
+	config, err := serverTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Listen("tcp", address, config)
+}
 
+// serverTLSConfig returns the TLS configuration of the server, requiring a
+// client certificate signed by the root CA.
+func serverTLSConfig() (*tls.Config, error) {
+	serverCert, err := tls.LoadX509KeyPair(serverCRTFilename, serverKeyFilename)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    certPool,
+		Rand:         rand.Reader,
+	}, nil
+}
+
+// serve passes the connections accepted by listener to handle, until the
+// server stops.
+func serve(listener net.Listener, msgs chan msgInfo, limiter *connLimiter, handle func(net.Conn, chan msgInfo)) {
+	onShutdown(func() { listener.Close() })
 	for {
 		conn, err := listener.Accept()
+		if err != nil && isStopping() {
+			return
+		}
 		if err != nil {
 			log.Fatalln("accept error:", err)
 		}
-		go handleClient(conn, msgs)
+		if err = limiter.acquire(conn.RemoteAddr()); err != nil {
+			log.Printf("refused connection from %s: %s", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+		go func() {
+			handle(conn, msgs)
+			limiter.release(conn.RemoteAddr())
+		}()
 	}
 }
 
 func handleClient(conn net.Conn, msgs chan msgInfo) {
 	var (
-		hdr [8]byte
-		err error
-		n   int
-		m   msgInfo
+		hdr     [hdrLen]byte
+		err     error
+		m       msgInfo
+		magic   string
+		dataLen int
+		ackSeq  uint64
+		nAck    int
+		nFrames int
+		codec   = defaultCodec()
+		inflate *decompressor
+		pong    [hdrLen]byte
+		flow    bool
+		pace    time.Duration
+		nPaced  int
+		mem     = &budget{max: int64(*connMemFlag)}
+		peer    = peerCredentials(conn)
+		client  *clientID
+		legacy  bool
 	)
+	setHeader(pong[:], pongMagic)
 	defer conn.Close()
+	p := register(conn)
+	if p == nil {
+		return
+	}
+	defer p.done()
 
-	for {
-		// decode and check message header
-		conn.SetReadDeadline(time.Now().Add(timeOutDelay))
-		_, err = conn.Read(hdr[:])
+	// in durable mode, the messages are acknowledged by the committer
+	var c *committer
+	if *durableFlag != "" {
+		conn = &syncConn{Conn: conn}
+		c = newCommitter(conn)
+		defer c.close()
+	}
+	r := dmon.NewBufReader(conn, 4096)
+
+	// flushAck sends the cumulative acknowledgment of the processed messages.
+	flushAck := func() error {
+		if nAck == 0 {
+			return nil
+		}
+		nAck = 0
+		return sendFrame(conn, newAckFrame(ackSeq))
+	}
+
+	for ; ; nFrames++ {
+		// send a cumulative acknowledgment before waiting for more frames
+		if r.Buffered() == 0 || nAck >= maxAckBatch {
+			if err = flushAck(); err != nil {
+				log.Println("send acknowledgment error:", err)
+				return
+			}
+		}
+
+		// decode and check message header, the first one with the TLS
+		// handshake within the handshake timeout
+		p.setIdle(r.Buffered() == 0)
+		if nFrames == 0 {
+			conn.SetReadDeadline(time.Now().Add(time.Duration(*handshakeTOFlag) * time.Second))
+		} else {
+			conn.SetReadDeadline(time.Now().Add(time.Duration(*idleFlag) * time.Second))
+		}
+		if isStopping() && r.Buffered() == 0 {
+			if c != nil {
+				c.close()
+			}
+			goAway(conn, legacy)
+			return
+		}
+		magic, dataLen, err = readHeader(r, hdr[:])
+		p.setIdle(false)
+		if err == nil && nFrames == 0 {
+			// the TLS handshake is complete
+			client = tlsIdentity(conn)
+			if client != nil && *msgFlag {
+				log.Printf("connection from %s authenticated as %s", conn.RemoteAddr(), client)
+			}
+		}
+		if err != nil && isStopping() {
+			if c != nil {
+				c.close()
+			}
+			if flushAck() == nil {
+				goAway(conn, legacy)
+			}
+			return
+		}
+		if e, ok := err.(net.Error); ok && e.Timeout() && nFrames == 0 {
+			log.Printf("handshake timeout: closing connection from %s", conn.RemoteAddr())
+			statHandshakeTO.inc()
+			return
+		}
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			log.Printf("idle timeout: closing connection from %s", conn.RemoteAddr())
+			return
+		}
 		if err != nil {
 			log.Println("recv message header error:", err)
 			return
 		}
-		if string(hdr[:4]) != "DMON" {
-			log.Printf("recv header error: expected 'DMON', got '%s' (0x%s)", string(hdr[:4]), hex.EncodeToString(hdr[:4]))
+
+		// answer heartbeat
+		if magic == pingMagic && dataLen == 0 {
+			if err = flushAck(); err == nil {
+				err = sendFrame(conn, pong[:])
+			}
+			if err != nil {
+				log.Println("send heartbeat error:", err)
+				return
+			}
+			continue
+		}
+		if magic != msgMagic && magic != seqMsgMagic && magic != subMagic && (magic != helloMagic || nFrames != 0) {
+			log.Printf("recv header error: expected '%s' or '%s', got '%s' (0x%s)", msgMagic, seqMsgMagic, magic, hex.EncodeToString(hdr[:4]))
 			return
 		}
-		dataLen := int(binary.LittleEndian.Uint32(hdr[4:]))
 
-		// decode message data
+		if dataLen > *maxFrameFlag {
+			log.Printf("recv header error: frame of %d bytes from %s exceeds %d bytes", dataLen, conn.RemoteAddr(), *maxFrameFlag)
+			statTooLarge.inc()
+			reply := &ReplyError{Status: StatusTooLarge, Reason: fmt.Sprintf("max frame size is %d bytes", *maxFrameFlag)}
+			if magic != seqMsgMagic || dataLen < seqLen {
+				if flushAck() == nil {
+					sendFrame(conn, newReplyFrame(reply))
+				}
+				return
+			}
+			// reject the message with its sequence number, and skip it
+			if reply.Seq, err = skipMessage(conn, r, dataLen); err != nil {
+				log.Println("recv message payload error:", err)
+				return
+			}
+			if err = flushAck(); err == nil {
+				err = sendFrame(conn, newReplyFrame(reply))
+			}
+			if err != nil {
+				log.Println("send reply error:", err)
+				return
+			}
+			continue
+		}
+
+		// read frame payload
 		conn.SetReadDeadline(time.Now().Add(timeOutDelay))
 		buf := make([]byte, dataLen)
-		_, err = conn.Read(buf)
+		_, err = r.ReadFull(buf)
 		if err != nil {
 			log.Println("recv message payload error:", err)
 			return
 		}
-		if *jsonFlag {
-			if *msgFlag {
-				log.Println("recv:", string(buf))
+
+		// negotiate connection options
+		if magic == helloMagic {
+			var h hello
+			var w *welcome
+			if err = json.Unmarshal(buf, &h); err == nil {
+				w, err = negotiate(&h)
 			}
-			err = m.msg.JSONDecode(buf)
-		} else {
-			err = m.msg.BinaryDecode(buf)
+			if err != nil {
+				log.Printf("handshake error: %s (client '%s')", err, h.Name)
+				sendFrame(conn, newReplyFrame(&ReplyError{Status: StatusUnsupported, Reason: err.Error()}))
+				return
+			}
+			codec = w.Codec
+			flow = true
+			if w.Compression == "deflate" {
+				inflate = &decompressor{}
+			}
+			buf, _ = json.Marshal(w)
+			buf = append(make([]byte, hdrLen, hdrLen+len(buf)), buf...)
+			setHeader(buf, helloMagic)
+			if err = sendFrame(conn, buf); err != nil {
+				log.Println("send handshake error:", err)
+				return
+			}
+			continue
 		}
-		if err != nil {
-			log.Println("decode message error:", err)
+
+		// stream the messages to a subscriber
+		if magic == subMagic {
+			if flushAck() == nil {
+				serveSubscription(conn, r, buf, codec, client)
+			}
 			return
 		}
 
-		// send acknowledgment
-		var b = [1]byte{ackCode}
-		conn.SetWriteDeadline(time.Now().Add(15 * time.Second))
-		n, err = conn.Write(b[:])
+		// decode message data
+		var seq uint64
+		if magic == seqMsgMagic {
+			if len(buf) < seqLen {
+				log.Printf("recv message payload error: expected at least %d bytes, got %d", seqLen, len(buf))
+				return
+			}
+			seq = binary.LittleEndian.Uint64(buf[:seqLen])
+			buf = buf[seqLen:]
+		}
+		if inflate != nil {
+			buf, err = inflate.decompress(buf, *maxFrameFlag)
+		}
+		if err == nil {
+			if *msgFlag && codec == "json" {
+				log.Println("recv:", string(buf))
+			}
+			err = codecs[codec].decode(&m.msg, buf)
+		}
+		if err == nil {
+			err = checkMsg(&m.msg)
+		}
 		if err != nil {
-			log.Println("send acknowledgment error:", err)
-			return
+			log.Println("decode message error:", err)
+			reply := &ReplyError{Status: StatusDecodeError, Seq: seq, Reason: err.Error()}
+			if err = flushAck(); err == nil {
+				err = sendFrame(conn, newReplyFrame(reply))
+			}
+			if err != nil {
+				log.Println("send reply error:", err)
+				return
+			}
+			continue
 		}
-		if n != 1 {
-			log.Printf("send acknowledgment error: expected 1 byte send, got %d", n)
-			return
+
+		// check the client may send the message
+		if err = authorize(client, &m.msg); err != nil {
+			if *msgFlag {
+				log.Printf("unauthorized message from %s: %s", conn.RemoteAddr(), err)
+			}
+			reply := &ReplyError{Status: StatusUnauthorized, Seq: seq, Reason: err.Error()}
+			if err = flushAck(); err == nil {
+				err = sendFrame(conn, newReplyFrame(reply))
+			}
+			if err != nil {
+				log.Println("send reply error:", err)
+				return
+			}
+			continue
 		}
 
 		// pass message to database writer
 		m.len = dataLen + len(hdr)
-		msgs <- m
+		if !mem.acquire(m.len) {
+			log.Printf("memory budget of %d bytes exceeded by %s", mem.max, conn.RemoteAddr())
+			reply := &ReplyError{Status: StatusServerBusy, Seq: seq, RetryAfter: budgetRetryDelay, Reason: "connection memory budget exceeded"}
+			if err = flushAck(); err == nil {
+				err = sendFrame(conn, newReplyFrame(reply))
+			}
+			if err != nil {
+				log.Println("send reply error:", err)
+				return
+			}
+			continue
+		}
+		m.budget = mem
+		m.peer = peer
+		m.client = client
+		legacy = magic == msgMagic
+		if c != nil {
+			m.stored = c.add(seq, legacy)
+		}
+		if err = enqueue(msgs, m); err != nil && c == nil {
+			log.Printf("message queue full: rejecting message from %s", conn.RemoteAddr())
+			reply := &ReplyError{Status: StatusServerBusy, Seq: seq, RetryAfter: retryDelay, Reason: err.Error()}
+			if err = flushAck(); err == nil {
+				err = sendFrame(conn, newReplyFrame(reply))
+			}
+			if err != nil {
+				log.Println("send reply error:", err)
+				return
+			}
+			continue
+		}
+
+		// send acknowledgment, once stored in durable mode
+		switch {
+		case c != nil:
+		case magic == msgMagic:
+			if err = sendFrame(conn, []byte{ackCode}); err != nil {
+				log.Println("send acknowledgment error:", err)
+				return
+			}
+		default:
+			ackSeq = seq
+			nAck++
+		}
+
+		// ask the client to slow down while the queue fills up
+		if flow {
+			fill := 100 * len(msgs) / cap(msgs)
+			d := pace
+			switch {
+			case pace == 0 && fill >= highWater:
+				d = slowDownDelay
+			case pace > 0 && fill >= highWater && nPaced >= maxAckBatch:
+				d = 2 * pace
+				if d > maxPace {
+					d = maxPace
+				}
+			case pace > 0 && fill <= lowWater:
+				d = 0
+			}
+			nPaced++
+			if d != pace {
+				if err = sendFrame(conn, newFlowFrame(d)); err != nil {
+					log.Println("send flow control error:", err)
+					return
+				}
+				if d > pace {
+					statSlowDown.inc()
+				} else {
+					statResume.inc()
+				}
+				pace, nPaced = d, 0
+			}
+		}
+	}
+}
+
+// goAway tells the client of conn that the server is stopping, unless it
+// uses the legacy protocol without reply frames. The pending acknowledgment
+// must have been sent.
+func goAway(conn net.Conn, legacy bool) {
+	if legacy {
+		return
+	}
+	reply := &ReplyError{Status: StatusGoingAway, Reason: "server shutting down"}
+	if err := sendFrame(conn, newReplyFrame(reply)); err != nil {
+		log.Println("send going away error:", err)
+	}
+}
+
+// sendFrame writes buf to conn.
+func sendFrame(conn net.Conn, buf []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(timeOutDelay))
+	n, err := conn.Write(buf)
+	if err == nil && n != len(buf) {
+		err = errors.Errorf("expected %d bytes send, got %d", len(buf), n)
 	}
+	return err
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The server stops on SIGINT or SIGTERM. It stops accepting connections and
+// datagrams, interrupts the connections waiting for a frame and tells their
+// clients it is going away, and lets the other connections finish the frames
+// they received. Once no more message can be queued, the queue is drained
+// and the database batch flushed. All this must complete within the
+// -shutdown deadline, otherwise the server exits with status 1.
+
+var (
+	stopping  = make(chan struct{})
+	stopMtx   sync.Mutex
+	stopped   bool
+	producers = make(map[*producer]struct{})
+	stopFuncs []func()
+	running   sync.WaitGroup
+)
+
+// producer is a goroutine queueing messages, with the connection it reads
+// them from, if any.
+type producer struct {
+	conn net.Conn
+	idle int32 // set while waiting for the next frame
+}
+
+// register returns the producer reading conn, which may be nil. It returns
+// nil when the server is stopping.
+func register(conn net.Conn) *producer {
+	stopMtx.Lock()
+	defer stopMtx.Unlock()
+	if stopped {
+		return nil
+	}
+	p := &producer{conn: conn}
+	producers[p] = struct{}{}
+	running.Add(1)
+	return p
+}
+
+// done unregisters the producer.
+func (p *producer) done() {
+	stopMtx.Lock()
+	delete(producers, p)
+	stopMtx.Unlock()
+	running.Done()
+}
+
+// setIdle records whether the producer is waiting for the next frame, and
+// may be interrupted by a shutdown.
+func (p *producer) setIdle(idle bool) {
+	var v int32
+	if idle {
+		v = 1
+	}
+	atomic.StoreInt32(&p.idle, v)
+}
+
+// isStopping returns true once the server is stopping.
+func isStopping() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// onShutdown registers f to be called when the server starts stopping, to
+// close a listener.
+func onShutdown(f func()) {
+	stopMtx.Lock()
+	stopFuncs = append(stopFuncs, f)
+	stopMtx.Unlock()
+}
+
+// waitShutdown waits for a stop signal and stops the server. sinksDone
+// receives the health of the sinks once they have flushed the messages.
+func waitShutdown(msgs chan msgInfo, sinksDone chan error) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("received %s: shutting down", <-sig)
+	start := time.Now()
+	deadline := time.After(time.Duration(*shutdownFlag) * time.Second)
+
+	// stop accepting connections and interrupt the idle ones
+	stopMtx.Lock()
+	stopped = true
+	close(stopping)
+	nConns := 0
+	for p := range producers {
+		if p.conn == nil {
+			continue
+		}
+		nConns++
+		if atomic.LoadInt32(&p.idle) == 1 {
+			p.conn.SetReadDeadline(time.Now())
+		}
+	}
+	for _, f := range stopFuncs {
+		f()
+	}
+	stopMtx.Unlock()
+
+	// wait until no message can be queued anymore
+	idle := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+	case <-deadline:
+		stopMtx.Lock()
+		n := len(producers)
+		stopMtx.Unlock()
+		log.Printf("shutdown deadline exceeded: %d connections still open, %d queued messages lost", n, len(msgs))
+		os.Exit(1)
+	}
+
+	// drain the message queue
+	queued := len(msgs)
+	close(msgs)
+	select {
+	case err := <-sinksDone:
+		if err != nil {
+			log.Printf("shutdown: %d connections closed, %d queued messages, flush error: %v", nConns, queued, err)
+			os.Exit(1)
+		}
+	case <-deadline:
+		log.Printf("shutdown deadline exceeded: %d connections closed, %d of %d queued messages lost", nConns, len(msgs), queued)
+		os.Exit(1)
+	}
+	log.Printf("shutdown: %d connections closed, %d queued messages drained in %v", nConns, queued, time.Since(start).Round(time.Millisecond))
+}
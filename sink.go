@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Sink is an output of the messages received by the server.
+type Sink interface {
+	// Write writes the messages, or buffers them until Flush. The storage
+	// result of each message must be reported with commit once written.
+	Write(ms []msgInfo) error
+	// Flush writes the buffered messages.
+	Flush() error
+	// Close flushes the buffered messages and releases the sink.
+	Close() error
+	// Health returns nil when the sink works, or the error of its last
+	// write.
+	Health() error
+}
+
+// The messages are delivered to each sink by its own goroutine, from a
+// buffer of the configured size. When the buffer of a sink is full, the
+// messages for this sink are dropped, unless it is a blocking sink which
+// then slows down the fan-out and all the sinks. In durable mode db, the
+// messages are acknowledged once written by the first mysql sink, which
+// always blocks.
+//
+// The sinks are configured in the -config file, e.g.
+//
+//	{"sinks": [
+//		{"name": "db", "type": "mysql", "dsn": "dmon:pass@/dmon", "block": true},
+//		{"name": "log", "type": "file", "path": "dmon.log", "max_size": 100000000,
+//			"rotate": "24h", "max_files": 30, "compress": true},
+//		{"name": "central", "type": "relay", "address": "central:3000", "tls": true},
+//		{"name": "recent", "type": "ring", "size": 100000, "max_age": "15m"},
+//		{"name": "count", "type": "stats"}
+//	]}
+//
+// Without -config, the server uses a mysql sink with -db, and a ring sink
+// otherwise.
+
+var (
+	statSinkWritten = newStatKeyedCounter("written")
+	statSinkDropped = newStatKeyedCounter("sink dropped")
+	statSinkError   = newStatKeyedCounter("sink error")
+)
+
+// sinkConfig is the configuration of a sink.
+type sinkConfig struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Buffer int    `json:"buffer"`    // max number of buffered messages
+	Batch  int    `json:"batch"`     // max number of messages per write
+	Linger int    `json:"linger_ms"` // delay before flushing a partial batch
+	Block  bool   `json:"block"`     // slow down the fan-out when full
+
+	// mysql
+	DSN string `json:"dsn"`
+
+	// file
+	Path     string `json:"path"`
+	Format   string `json:"format"`    // ndjson or text
+	MaxSize  int64  `json:"max_size"`  // rotate before exceeding this size
+	Rotate   string `json:"rotate"`    // rotation period
+	MaxFiles int    `json:"max_files"` // max number of rotated files kept
+	MaxDays  int    `json:"max_days"`  // max age of rotated files kept
+	Compress bool   `json:"compress"`  // gzip the rotated files, or deflate the relayed messages
+
+	// relay
+	Address string `json:"address"`  // upstream server
+	Window  int    `json:"window"`   // max number of unacknowledged messages
+	TLS     bool   `json:"tls"`      // use TLS on tcp, as with -tls
+	RelayID string `json:"relay_id"` // default: host name/-a address
+	MaxHops int    `json:"max_hops"` // max number of relays of a message
+
+	// ring
+	Size   int    `json:"size"`    // max number of messages kept
+	MaxAge string `json:"max_age"` // max age of the messages kept
+}
+
+// defaultSinkBuffer is the default buffer size of a sink.
+const defaultSinkBuffer = 1000
+
+// sinkTypes are the sink constructors by type name.
+var sinkTypes = map[string]func(c *sinkConfig) (Sink, error){
+	"mysql": newMySQLSink,
+	"file":  newFileSink,
+	"relay": newRelaySink,
+	"ring":  newRingSink,
+	"stats": func(c *sinkConfig) (Sink, error) { return statsSink{}, nil },
+}
+
+// config is the content of the -config file.
+type config struct {
+	Sinks  []sinkConfig  `json:"sinks"`
+	Routes []routeConfig `json:"routes"`
+}
+
+// loadConfig returns the configuration read from the file path, or the
+// default configuration when path is empty.
+func loadConfig(path string) (*config, error) {
+	if path == "" {
+		c := &config{Sinks: []sinkConfig{{Name: "recent", Type: "ring", Block: true}}}
+		if *dbFlag {
+			c.Sinks[0] = sinkConfig{Name: "db", Type: "mysql", DSN: mysqlCredentials, Block: true}
+		}
+		return c, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "load config")
+	}
+	var c config
+	if err = json.Unmarshal(data, &c); err != nil {
+		return nil, errors.Wrapf(err, "load config %s", path)
+	}
+	if len(c.Sinks) == 0 {
+		return nil, errors.Errorf("load config %s: no sinks", path)
+	}
+	return &c, nil
+}
+
+// sinkRunner delivers the messages to a sink.
+type sinkRunner struct {
+	conf   sinkConfig
+	sink   Sink
+	in     chan msgInfo
+	commit bool      // reports the storage results in durable mode
+	held   []msgInfo // written messages waiting for the next flush
+	err    error
+}
+
+// newSinks returns the runners of the configured sinks.
+func newSinks(c *config) ([]*sinkRunner, error) {
+	var rs []*sinkRunner
+	names := make(map[string]bool)
+	committer := false
+	for _, sc := range c.Sinks {
+		if sc.Name == "" {
+			sc.Name = sc.Type
+		}
+		if names[sc.Name] {
+			return nil, errors.Errorf("duplicate sink name '%s'", sc.Name)
+		}
+		names[sc.Name] = true
+		newSink, ok := sinkTypes[sc.Type]
+		if !ok {
+			return nil, errors.Errorf("sink %s: unknown type '%s'", sc.Name, sc.Type)
+		}
+		if sc.Buffer <= 0 {
+			sc.Buffer = defaultSinkBuffer
+		}
+		if sc.Batch <= 0 {
+			sc.Batch = *dbBufLenFlag
+		}
+		if sc.Linger <= 0 {
+			sc.Linger = *dbFlushFlag
+		}
+		r := &sinkRunner{conf: sc}
+		if sc.Type == "mysql" && *durableFlag == "db" && !committer {
+			r.commit, r.conf.Block, r.conf.Linger = true, true, 0
+			committer = true
+		}
+		var err error
+		if r.sink, err = newSink(&r.conf); err != nil {
+			return nil, errors.Wrapf(err, "sink %s", sc.Name)
+		}
+		r.in = make(chan msgInfo, r.conf.Buffer)
+		rs = append(rs, r)
+	}
+	if *durableFlag == "db" && !committer {
+		return nil, errors.New("durable mode 'db' requires a mysql sink")
+	}
+	return rs, nil
+}
+
+// errNotCommitted is the result of a message that the routes don't deliver
+// to the committing sink.
+var errNotCommitted = errors.New("message not routed to the database")
+
+// fanOut delivers the messages received from msgs to the sinks selected by
+// rt, or to all the sinks when rt is nil, until msgs is closed. It returns
+// the health of the sinks once closed.
+// In durable mode, a message routed away from the committing sink is
+// rejected with errNotCommitted since it is not stored in the database.
+func fanOut(msgs chan msgInfo, rs []*sinkRunner, rt *router) error {
+	statStart(time.Duration(*periodFlag) * time.Second)
+	var wg sync.WaitGroup
+	for _, r := range rs {
+		wg.Add(1)
+		go func(r *sinkRunner) {
+			r.run()
+			wg.Done()
+		}(r)
+	}
+
+	var dest []bool
+	for m := range msgs {
+		statUpdate(m.len)
+		publish(&m.msg)
+		if rt != nil {
+			if dest, _ = rt.route(&m.msg); !anyTrue(dest) {
+				statUnrouted.inc()
+			}
+		}
+		n := 0
+		for i, r := range rs {
+			if dest != nil && !dest[i] {
+				if r.commit {
+					m.commit(errNotCommitted)
+				}
+				continue
+			}
+			n++
+		}
+		if n == 0 {
+			m.done()
+			continue
+		}
+		if n > 1 {
+			refs := int32(n)
+			m.refs = &refs
+		}
+		for i, r := range rs {
+			if dest != nil && !dest[i] {
+				continue
+			}
+			c := m
+			if !r.commit {
+				c.stored = nil
+			}
+			if r.conf.Block {
+				r.in <- c
+				continue
+			}
+			select {
+			case r.in <- c:
+			default:
+				statSinkDropped.inc(r.conf.Name)
+				c.commit(errDropped)
+				c.done()
+			}
+		}
+	}
+
+	var err error
+	for _, r := range rs {
+		close(r.in)
+	}
+	wg.Wait()
+	for _, r := range rs {
+		if r.err != nil && err == nil {
+			err = errors.Wrapf(r.err, "sink %s", r.conf.Name)
+		}
+	}
+	return err
+}
+
+// anyTrue returns true if one of bs is true.
+func anyTrue(bs []bool) bool {
+	for _, b := range bs {
+		if b {
+			return true
+		}
+	}
+	return false
+}
+
+// run writes the messages in batches, and flushes the sink when no message
+// came during the linger delay, or once it holds as many messages as its
+// buffer size. It closes the sink once in is closed.
+func (r *sinkRunner) run() {
+	linger := time.Duration(r.conf.Linger) * time.Millisecond
+	timer := time.NewTimer(linger)
+	timer.Stop()
+	batch := make([]msgInfo, 0, r.conf.Batch)
+	for {
+		select {
+		case m, ok := <-r.in:
+			if !ok {
+				timer.Stop()
+				r.check(r.sink.Close())
+				r.release()
+				return
+			}
+			batch = append(batch[:0], m)
+		collect:
+			for len(batch) < r.conf.Batch {
+				select {
+				case m, ok := <-r.in:
+					if !ok {
+						break collect
+					}
+					batch = append(batch, m)
+				default:
+					break collect
+				}
+			}
+			if r.check(r.sink.Write(batch)) {
+				statSinkWritten.add(r.conf.Name, uint64(len(batch)))
+			}
+			r.held = append(r.held, batch...)
+			switch {
+			case len(r.held) >= r.conf.Buffer, len(r.in) == 0 && linger == 0:
+				r.flush()
+			case len(r.in) == 0:
+				timer.Reset(linger)
+			}
+		case <-timer.C:
+			r.flush()
+		}
+	}
+}
+
+// flush flushes the sink and releases the budget of the written messages,
+// which are then stored, or dropped by the sink if the flush failed.
+func (r *sinkRunner) flush() {
+	r.check(r.sink.Flush())
+	r.release()
+}
+
+// release releases the budget of the held messages.
+func (r *sinkRunner) release() {
+	for i := range r.held {
+		r.held[i].done()
+		r.held[i] = msgInfo{}
+	}
+	r.held = r.held[:0]
+}
+
+// check counts the error err of a sink operation, logs the changes of the
+// sink health, and returns true if err is nil.
+func (r *sinkRunner) check(err error) bool {
+	if err != nil {
+		statSinkError.inc(r.conf.Name)
+	}
+	health := err
+	if health == nil {
+		health = r.sink.Health()
+	}
+	switch {
+	case health != nil && r.err == nil:
+		log.Printf("sink %s failed: %v", r.conf.Name, health)
+	case health == nil && r.err != nil:
+		log.Printf("sink %s recovered", r.conf.Name)
+	}
+	r.err = health
+	return err == nil
+}
+
+// statsSink discards the messages, which are only counted in the stats.
+type statsSink struct{}
+
+func (statsSink) Write(ms []msgInfo) error {
+	for i := range ms {
+		ms[i].commit(nil)
+	}
+	return nil
+}
+
+func (statsSink) Flush() error  { return nil }
+func (statsSink) Close() error  { return nil }
+func (statsSink) Health() error { return nil }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chmike/go-dmon/dmon"
+)
+
+// stalledSink stores the messages once release is closed.
+type stalledSink struct {
+	release chan struct{}
+}
+
+func (s *stalledSink) Write(ms []msgInfo) error {
+	<-s.release
+	for i := range ms {
+		ms[i].commit(nil)
+	}
+	return nil
+}
+
+func (s *stalledSink) Flush() error  { return nil }
+func (s *stalledSink) Close() error  { return nil }
+func (s *stalledSink) Health() error { return nil }
+
+// TestFanOutRoutedAway checks that in durable mode a message routed away
+// from the committing sink, or matching no route, is rejected after the
+// previous messages are stored.
+func TestFanOutRoutedAway(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		routes []routeConfig
+	}{
+		{"routed away", []routeConfig{{Levels: []string{"error"}, Sinks: []string{"db"}}, {Sinks: []string{"log"}}}},
+		{"unrouted", []routeConfig{{Levels: []string{"error"}, Sinks: []string{"db", "log"}}}},
+	} {
+		rt, err := newRouter(&config{
+			Sinks:  []sinkConfig{{Name: "db", Type: "mysql"}, {Name: "log", Type: "stats"}},
+			Routes: test.routes,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		db := &stalledSink{release: make(chan struct{})}
+		rs := []*sinkRunner{
+			{conf: sinkConfig{Name: "db", Batch: 1, Block: true}, sink: db, in: make(chan msgInfo, 1), commit: true},
+			{conf: sinkConfig{Name: "log", Batch: 1, Block: true}, sink: statsSink{}, in: make(chan msgInfo, 1)},
+		}
+		msgs := make(chan msgInfo, 2)
+		done := make(chan error)
+		go func() { done <- fanOut(msgs, rs, rt) }()
+
+		srv, cli := net.Pipe()
+		cm := newCommitter(srv)
+		msgs <- msgInfo{msg: dmon.Msg{Level: "error"}, stored: cm.add(1, false)}
+		msgs <- msgInfo{msg: dmon.Msg{Level: "info"}, stored: cm.add(2, false)}
+
+		cli.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if a := readAck(dmon.NewBufReader(cli, 4096)); a.err == nil {
+			t.Fatalf("%s: got ack %d, reply %v before the message 1 is stored", test.name, a.seq, a.reply)
+		}
+		close(db.release)
+		cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+		r := dmon.NewBufReader(cli, 4096)
+		if a := readAck(r); a.err != nil || a.reply != nil || a.seq != 1 {
+			t.Fatalf("%s: got ack %d, reply %v, error %v, expected ack 1", test.name, a.seq, a.reply, a.err)
+		}
+		if a := readAck(r); a.err != nil || a.reply == nil || a.reply.Seq != 2 || a.reply.Status != StatusStorageError {
+			t.Fatalf("%s: got ack %d, reply %v, error %v, expected rejection of 2", test.name, a.seq, a.reply, a.err)
+		}
+		cm.close()
+		cli.Close()
+		close(msgs)
+		if err = <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestFanOutBudget checks that the budget of a message is released once all
+// its sinks wrote and flushed it.
+func TestFanOutBudget(t *testing.T) {
+	slow := &stalledSink{release: make(chan struct{})}
+	rs := []*sinkRunner{
+		{conf: sinkConfig{Name: "slow", Batch: 1, Block: true}, sink: slow, in: make(chan msgInfo, 1)},
+		{conf: sinkConfig{Name: "fast", Batch: 1, Block: true}, sink: statsSink{}, in: make(chan msgInfo, 1)},
+	}
+	msgs := make(chan msgInfo, 1)
+	done := make(chan error)
+	go func() { done <- fanOut(msgs, rs, nil) }()
+
+	b := &budget{max: 100}
+	b.acquire(10)
+	msgs <- msgInfo{len: 10, budget: b}
+	time.Sleep(100 * time.Millisecond)
+	if used := atomic.LoadInt64(&b.used); used != 10 {
+		t.Fatalf("got %d bytes used before the slow sink wrote the message, expected 10", used)
+	}
+	close(slow.release)
+	close(msgs)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if used := atomic.LoadInt64(&b.used); used != 0 {
+		t.Fatalf("got %d bytes used once written, expected 0", used)
+	}
+}
+
+// TestSinkRunnerBudget checks that a sink runner releases the budget of the
+// messages once it flushes the sink, and not when it writes them.
+func TestSinkRunnerBudget(t *testing.T) {
+	r := &sinkRunner{
+		conf: sinkConfig{Name: "log", Batch: 1, Buffer: 2, Linger: 3600000},
+		sink: statsSink{},
+		in:   make(chan msgInfo, 2),
+	}
+	done := make(chan struct{})
+	go func() {
+		r.run()
+		close(done)
+	}()
+
+	b := &budget{max: 100}
+	b.acquire(10)
+	r.in <- msgInfo{len: 10, budget: b}
+	time.Sleep(100 * time.Millisecond)
+	if used := atomic.LoadInt64(&b.used); used != 10 {
+		t.Fatalf("got %d bytes used before the flush, expected 10", used)
+	}
+	b.acquire(10)
+	r.in <- msgInfo{len: 10, budget: b}
+	time.Sleep(100 * time.Millisecond)
+	if used := atomic.LoadInt64(&b.used); used != 0 {
+		t.Fatalf("got %d bytes used once the sink buffer is full, expected 0", used)
+	}
+	b.acquire(10)
+	r.in <- msgInfo{len: 10, budget: b}
+	close(r.in)
+	<-done
+	if used := atomic.LoadInt64(&b.used); used != 0 {
+		t.Fatalf("got %d bytes used once closed, expected 0", used)
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -25,6 +27,64 @@ type statInfo struct {
 
 var stats = statInfo{stamp: time.Now()}
 
+// statCounter counts events displayed with the stats when they occurred
+// during the period.
+type statCounter struct {
+	name string
+	n    uint64
+}
+
+var statCounters []*statCounter
+
+// newStatCounter returns a counter displayed with the stats under name.
+func newStatCounter(name string) *statCounter {
+	c := &statCounter{name: name}
+	statCounters = append(statCounters, c)
+	return c
+}
+
+func (c *statCounter) inc() {
+	atomic.AddUint64(&c.n, 1)
+}
+
+func (c *statCounter) add(n uint64) {
+	atomic.AddUint64(&c.n, n)
+}
+
+// statKeyedCounter counts events by key, displayed with the stats as
+// name[key] when they occurred during the period.
+type statKeyedCounter struct {
+	name string
+	mtx  sync.Mutex
+	n    map[string]uint64
+}
+
+var statKeyedCounters []*statKeyedCounter
+
+// newStatKeyedCounter returns a counter by key displayed with the stats under
+// name.
+func newStatKeyedCounter(name string) *statKeyedCounter {
+	c := &statKeyedCounter{name: name, n: make(map[string]uint64)}
+	statKeyedCounters = append(statKeyedCounters, c)
+	return c
+}
+
+func (c *statKeyedCounter) inc(key string) {
+	c.add(key, 1)
+}
+
+func (c *statKeyedCounter) add(key string, n uint64) {
+	c.mtx.Lock()
+	c.n[key] += n
+	c.mtx.Unlock()
+}
+
+var (
+	statThrottled = newStatCounter("throttled")
+	statSlowDown  = newStatCounter("slow down")
+	statResume    = newStatCounter("resume")
+)
+
 func statStart(period time.Duration) {
 	stats.stamp = time.Now()
 	cpuTicks, idleTicks, totalTicks := getCPUStats()
@@ -62,9 +122,35 @@ func statDisplay(period time.Duration) {
 		stats.cpuTicks = cpuTicks
 		stats.idleTicks = idleTicks
 		stats.totalTicks = totalTicks
-		log.Printf("%.3f usec/msg, %.3f B/msg, %.3f kHz, %.3f MB/s, cpu: %.1f%% idle: %.1f%%\n",
-			usmsg, mLen, rate/1000, mbs, cpu, idle)
+		log.Printf("%.3f usec/msg, %.3f B/msg, %.3f kHz, %.3f MB/s, cpu: %.1f%% idle: %.1f%%%s\n",
+			usmsg, mLen, rate/1000, mbs, cpu, idle, statEvents())
+	}
+}
+
+// statEvents returns the counts of the events that occurred since the last
+// call.
+func statEvents() string {
+	var s string
+	for _, c := range statCounters {
+		if n := atomic.SwapUint64(&c.n, 0); n != 0 {
+			s += fmt.Sprintf(", %s: %d", c.name, n)
+		}
+	}
+	for _, c := range statKeyedCounters {
+		c.mtx.Lock()
+		counts := c.n
+		c.n = make(map[string]uint64)
+		c.mtx.Unlock()
+		keys := make([]string, 0, len(counts))
+		for k := range counts {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s += fmt.Sprintf(", %s[%s]: %d", c.name, k, counts[k])
+		}
 	}
+	return s
 }
 
 var pidStr = strconv.Itoa(os.Getpid())
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chmike/go-dmon/dmon"
+	"github.com/chmike/go-dmon/filter"
+	"github.com/pkg/errors"
+)
+
+// A client may subscribe to the messages received by the server by sending
+// a subMagic frame on a new connection, possibly after a handshake. Its
+// payload is a JSON subscription with a filter expression (see package
+// filter), empty to receive all the messages. The server answers with a
+// StatusOK reply frame, or a rejection, and then streams the matching
+// messages in msgMagic frames, encoded with the codec of the subscription
+// or of the connection. The client may send ping frames, answered by pong
+// frames, and nothing else.
+//
+// With a -policy, the subscriber only receives the messages it may read,
+// and its subscription is rejected when it may read none.
+//
+// The messages are queued for each subscriber in a buffer of subBufLen
+// messages. When the buffer of a slow subscriber is full, the messages are
+// dropped and the number of dropped messages is sent in a dropMagic frame
+// before the next message. Subscribers never slow down the server.
+//
+// The tail command prints the messages of a subscription, e.g.
+//
+//	dmon -a host:3000 -tailfmt short tail 'level >= warn && system == "billing"'
+
+const (
+	subBufLen    = 1000
+	subDropCheck = time.Second
+)
+
+var statTailDropped = newStatCounter("tail dropped")
+
+// subscription is the payload of a subMagic frame.
+type subscription struct {
+	Filter string `json:"filter"`
+	Codec  string `json:"codec,omitempty"`
+}
+
+// subscriber is a connection receiving the messages matching its filter.
+type subscriber struct {
+	filter  *filter.Filter
+	client  *clientID
+	msgs    chan dmon.Msg
+	dropped uint64
+}
+
+var (
+	subsMtx sync.RWMutex
+	subs    = make(map[*subscriber]struct{})
+	nSubs   int32
+)
+
+// publish queues m for the subscribers whose filter matches m, and drops it
+// for those whose buffer is full.
+func publish(m *dmon.Msg) {
+	if atomic.LoadInt32(&nSubs) == 0 {
+		return
+	}
+	subsMtx.RLock()
+	defer subsMtx.RUnlock()
+	for s := range subs {
+		if s.filter != nil && !s.filter.Match(m) {
+			continue
+		}
+		if !readable(s.client, m) {
+			continue
+		}
+		select {
+		case s.msgs <- *m:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+			statTailDropped.inc()
+		}
+	}
+}
+
+// subscribe adds a subscriber with filter f for client, and returns nil if
+// there are already -tailmax subscribers.
+func subscribe(f *filter.Filter, client *clientID) *subscriber {
+	subsMtx.Lock()
+	defer subsMtx.Unlock()
+	if len(subs) >= *tailMaxFlag {
+		return nil
+	}
+	s := &subscriber{filter: f, client: client, msgs: make(chan dmon.Msg, subBufLen)}
+	subs[s] = struct{}{}
+	atomic.StoreInt32(&nSubs, int32(len(subs)))
+	return s
+}
+
+// unsubscribe removes the subscriber s.
+func unsubscribe(s *subscriber) {
+	subsMtx.Lock()
+	defer subsMtx.Unlock()
+	delete(subs, s)
+	atomic.StoreInt32(&nSubs, int32(len(subs)))
+}
+
+// serveSubscription streams the messages of the subscription in payload
+// buf to conn, read by r, until the client closes the connection or the
+// server stops. codec is the codec of the connection, and client the
+// identity of the client, if any.
+func serveSubscription(conn net.Conn, r *dmon.BufReader, buf []byte, codec string, client *clientID) {
+	var sub subscription
+	reply := &ReplyError{Status: StatusOK, Reason: "subscribed"}
+	var f *filter.Filter
+	err := json.Unmarshal(buf, &sub)
+	if err == nil && sub.Filter != "" {
+		f, err = filter.Compile(sub.Filter)
+	}
+	if sub.Codec != "" {
+		codec = sub.Codec
+	}
+	var s *subscriber
+	switch _, ok := codecs[codec]; {
+	case err != nil:
+		reply = &ReplyError{Status: StatusDecodeError, Reason: "invalid subscription: " + err.Error()}
+	case !ok:
+		reply = &ReplyError{Status: StatusUnsupported, Reason: "unsupported codec " + codec}
+	case !mayRead(client):
+		reply = &ReplyError{Status: StatusUnauthorized, Reason: "client may not read messages"}
+	default:
+		if s = subscribe(f, client); s == nil {
+			reply = &ReplyError{Status: StatusServerBusy, Reason: "too many subscribers"}
+		}
+	}
+	if err = sendFrame(conn, newReplyFrame(reply)); err != nil || s == nil {
+		return
+	}
+	defer unsubscribe(s)
+	if *msgFlag {
+		log.Printf("subscription from %s: %q", conn.RemoteAddr(), sub.Filter)
+	}
+
+	// read the pings of the client until it closes the connection
+	pings, gone := make(chan struct{}, 1), make(chan struct{})
+	go func() {
+		defer close(gone)
+		var hdr [hdrLen]byte
+		for {
+			conn.SetReadDeadline(time.Time{})
+			magic, dataLen, err := readHeader(r, hdr[:])
+			if err != nil || magic != pingMagic || dataLen != 0 {
+				return
+			}
+			select {
+			case pings <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	var pong [hdrLen]byte
+	setHeader(pong[:], pongMagic)
+	ticker := time.NewTicker(subDropCheck)
+	defer ticker.Stop()
+	out := make([]byte, 0, 4096)
+	for {
+		out = out[:0]
+		select {
+		case m := <-s.msgs:
+			for n := len(s.msgs); ; n-- {
+				out = appendDropFrame(out, s)
+				if out, err = appendMsgFrame(out, &m, codec); err != nil {
+					log.Println("subscription encode error:", err)
+					return
+				}
+				if n == 0 || len(out) >= 64*1024 {
+					break
+				}
+				m = <-s.msgs
+			}
+		case <-pings:
+			out = append(out, pong[:]...)
+		case <-ticker.C:
+			out = appendDropFrame(out, s)
+		case <-gone:
+			return
+		case <-stopping:
+			goAway(conn, false)
+			return
+		}
+		if len(out) == 0 {
+			continue
+		}
+		if err = sendFrame(conn, out); err != nil {
+			log.Println("send subscription error:", err)
+			return
+		}
+	}
+}
+
+// appendDropFrame appends to buf a dropMagic frame with the number of
+// messages dropped for s since the last call, if any.
+func appendDropFrame(buf []byte, s *subscriber) []byte {
+	n := atomic.SwapUint64(&s.dropped, 0)
+	if n == 0 {
+		return buf
+	}
+	start := len(buf)
+	buf = append(buf, make([]byte, hdrLen+8)...)
+	binary.LittleEndian.PutUint64(buf[start+hdrLen:], n)
+	setHeader(buf[start:], dropMagic)
+	return buf
+}
+
+// appendMsgFrame appends to buf the msgMagic frame of m encoded with codec.
+func appendMsgFrame(buf []byte, m *dmon.Msg, codec string) ([]byte, error) {
+	start := len(buf)
+	buf, err := codecs[codec].encode(m, append(buf, make([]byte, hdrLen)...))
+	if err != nil {
+		return buf[:start], err
+	}
+	setHeader(buf[start:], msgMagic)
+	return buf, nil
+}
+
+// tailFormats are the output formats of the tail command.
+var tailFormats = map[string]func([]byte, *dmon.Msg) []byte{
+	"text": appendLogfmt,
+	"json": func(buf []byte, m *dmon.Msg) []byte {
+		data, _ := json.Marshal(m)
+		return append(append(buf, data...), '\n')
+	},
+	"short": func(buf []byte, m *dmon.Msg) []byte {
+		buf = m.Stamp.Local().AppendFormat(buf, "15:04:05.000")
+		buf = append(buf, fmt.Sprintf(" %-5s %s/%s: %s", m.Level, m.System, m.Component, m.Message)...)
+		return append(buf, '\n')
+	},
+}
+
+// runTail prints the messages matching the filter expression in args
+// received from the server, and subscribes again when disconnected.
+func runTail(args []string) {
+	log.SetPrefix("tail ")
+	if len(args) > 1 {
+		log.Fatalf("usage: dmon [flags] tail [filter]")
+	}
+	output, ok := tailFormats[*tailFmtFlag]
+	if !ok {
+		log.Fatalf("invalid tail format '%s'", *tailFmtFlag)
+	}
+	sub := subscription{Codec: "binary"}
+	if len(args) == 1 {
+		sub.Filter = args[0]
+		if _, err := filter.Compile(sub.Filter); err != nil {
+			log.Fatalf("invalid filter: %v", err)
+		}
+	}
+	for {
+		err := tail(&sub, output)
+		if e, ok := err.(*ReplyError); ok && !e.Status.Retry() && e.Status != StatusGoingAway {
+			log.Fatal(err)
+		}
+		log.Printf("%v, wait 2 seconds", err)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// tail subscribes to the messages of the server and prints them with
+// output until an error occurs.
+func tail(sub *subscription, output func([]byte, *dmon.Msg) []byte) error {
+	conn, err := dial(*addressFlag, *tlsFlag)
+	if err != nil {
+		return errors.Wrap(err, "connect")
+	}
+	l := &link{Conn: conn, lastRecv: time.Now().UnixNano(), done: make(chan struct{})}
+	defer func() {
+		close(l.done)
+		conn.Close()
+	}()
+	data, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+	buf := append(make([]byte, hdrLen, hdrLen+len(data)), data...)
+	setHeader(buf, subMagic)
+	if err = l.write(buf); err != nil {
+		return errors.Wrap(err, "subscribe")
+	}
+	r := dmon.NewBufReader(conn, 4096)
+	a := readAck(r)
+	if a.err == nil && a.reply == nil {
+		a.err = errors.New("unexpected acknowledgment")
+	}
+	if a.err != nil {
+		return errors.Wrap(a.err, "subscribe")
+	}
+	if a.reply.Status != StatusOK {
+		return a.reply
+	}
+	if *heartbeatFlag > 0 {
+		go l.heartbeat(time.Duration(*heartbeatFlag) * time.Second)
+	}
+	var (
+		hdr [hdrLen]byte
+		m   dmon.Msg
+		out []byte
+	)
+	for {
+		magic, dataLen, err := readHeader(r, hdr[:])
+		if err != nil {
+			return errors.Wrap(err, "recv message")
+		}
+		atomic.StoreInt64(&l.lastRecv, time.Now().UnixNano())
+		if dataLen > *maxFrameFlag {
+			return errors.Errorf("recv message: frame of %d bytes", dataLen)
+		}
+		data := make([]byte, dataLen)
+		if _, err = r.ReadFull(data); err != nil {
+			return errors.Wrap(err, "recv message")
+		}
+		switch {
+		case magic == msgMagic:
+			if err = codecs[sub.Codec].decode(&m, data); err != nil {
+				return errors.Wrap(err, "decode message")
+			}
+			out = output(out[:0], &m)
+			os.Stdout.Write(out)
+		case magic == dropMagic && dataLen == 8:
+			log.Printf("%d messages dropped by the server", binary.LittleEndian.Uint64(data))
+		case magic == replyMagic && parseReply(data) != nil:
+			return parseReply(data)
+		case magic == pongMagic:
+		default:
+			return errors.Errorf("recv message: unexpected '%s' frame", magic)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/chmike/go-dmon/dmon"
+	"github.com/pkg/errors"
+)
+
+// A datagram holds the udpMagic, a sequence number incremented with each
+// datagram sent, the codec identifier and one or more messages, each one
+// preceded by its length as a little endian uint32.
+const (
+	udpMagic  = "DMUD"
+	udpHdrLen = 4 + seqLen + 1
+
+	// maxDatagramLen is the maximum payload size of an UDP datagram.
+	maxDatagramLen = 65507
+)
+
+// udpCodecs are the codecs identified by their index in datagrams.
+var udpCodecs = []string{"binary", "json"}
+
+var (
+	statMalformed = newStatCounter("malformed datagram")
+	statSeqGap    = newStatCounter("lost datagram")
+)
+
+// MsgLogUDP sends messages to the logging server in UDP datagrams, without
+// acknowledgment. The messages are packed in datagrams of at most MTU bytes,
+// sent when the next message doesn't fit, or Delay after the first message
+// of the datagram.
+type MsgLogUDP struct {
+	Address string
+	MTU     int
+	Delay   time.Duration
+	mtx     sync.Mutex
+	conn    net.Conn
+	err     error
+	seq     uint64
+	buf     []byte
+	tmp     []byte
+	timer   *time.Timer
+}
+
+// Error returns the last error.
+func (lu *MsgLogUDP) Error() error {
+	lu.mtx.Lock()
+	defer lu.mtx.Unlock()
+	return lu.err
+}
+
+// SendMessage adds the message m to the datagram to send.
+func (lu *MsgLogUDP) SendMessage(m *dmon.Msg) int {
+	lu.mtx.Lock()
+	defer lu.mtx.Unlock()
+	lu.err = nil
+	if lu.conn == nil {
+		if lu.conn, lu.err = net.Dial("udp", lu.Address); lu.err != nil {
+			lu.conn = nil
+			lu.err = errors.Wrap(lu.err, "dial")
+			return 0
+		}
+	}
+	codec := defaultCodec()
+	lu.tmp, lu.err = codecs[codec].encode(m, append(lu.tmp[:0], 0, 0, 0, 0))
+	if lu.err != nil {
+		lu.err = errors.Wrap(lu.err, "send message")
+		return 0
+	}
+	binary.LittleEndian.PutUint32(lu.tmp, uint32(len(lu.tmp)-4))
+	mtu := lu.MTU
+	if mtu <= udpHdrLen || mtu > maxDatagramLen {
+		mtu = maxDatagramLen
+	}
+	if udpHdrLen+len(lu.tmp) > mtu {
+		lu.err = errors.Errorf("send message: message of %d bytes exceeds MTU", len(lu.tmp))
+		return 0
+	}
+	if len(lu.buf)+len(lu.tmp) > mtu {
+		if lu.flush(); lu.err != nil {
+			return 0
+		}
+	}
+	if len(lu.buf) == 0 {
+		lu.seq++
+		lu.buf = append(lu.buf[:0], udpMagic...)
+		lu.buf = append(lu.buf, 0, 0, 0, 0, 0, 0, 0, 0, codecID(codec))
+		binary.LittleEndian.PutUint64(lu.buf[4:], lu.seq)
+		if lu.timer == nil {
+			lu.timer = time.AfterFunc(lu.Delay, lu.timeout)
+		} else {
+			lu.timer.Reset(lu.Delay)
+		}
+	}
+	lu.buf = append(lu.buf, lu.tmp...)
+	return len(lu.tmp)
+}
+
+// Flush sends the pending datagram.
+func (lu *MsgLogUDP) Flush() error {
+	lu.mtx.Lock()
+	defer lu.mtx.Unlock()
+	lu.flush()
+	return lu.err
+}
+
+// Close sends the pending datagram and closes the connection.
+func (lu *MsgLogUDP) Close() error {
+	lu.mtx.Lock()
+	defer lu.mtx.Unlock()
+	lu.flush()
+	if lu.conn != nil {
+		lu.conn.Close()
+		lu.conn = nil
+	}
+	return lu.err
+}
+
+func (lu *MsgLogUDP) timeout() {
+	lu.mtx.Lock()
+	lu.flush()
+	lu.mtx.Unlock()
+}
+
+// flush sends the pending datagram. The mutex must be locked.
+func (lu *MsgLogUDP) flush() {
+	if len(lu.buf) == 0 || lu.conn == nil {
+		return
+	}
+	lu.timer.Stop()
+	_, lu.err = lu.conn.Write(lu.buf)
+	lu.buf = lu.buf[:0]
+	if lu.err != nil {
+		lu.err = errors.Wrap(lu.err, "send datagram")
+		lu.conn.Close()
+		lu.conn = nil
+	}
+}
+
+func codecID(name string) byte {
+	for i, c := range udpCodecs {
+		if c == name {
+			return byte(i)
+		}
+	}
+	return 0
+}
+
+// listenUDP passes the messages received in datagrams on address to msgs.
+func listenUDP(address string, msgs chan msgInfo) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		log.Fatalln("failed listen udp:", err)
+	}
+	log.Println("listen udp:", address)
+	p := register(nil)
+	if p == nil {
+		conn.Close()
+		return
+	}
+	defer p.done()
+	onShutdown(func() { conn.Close() })
+
+	lastSeq := make(map[string]uint64)
+	buf := make([]byte, maxDatagramLen)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil && isStopping() {
+			return
+		}
+		if err != nil {
+			log.Fatalln("udp read error:", err)
+		}
+		seq, err := decodeDatagram(buf[:n], msgs)
+		if err != nil {
+			statMalformed.inc()
+			if *msgFlag {
+				log.Printf("malformed datagram from %s: %s", addr, err)
+			}
+			continue
+		}
+
+		// detect lost datagrams, assuming a restart when seq goes back
+		src := addr.String()
+		if last, ok := lastSeq[src]; ok && seq > last+1 {
+			statSeqGap.add(seq - last - 1)
+		}
+		if len(lastSeq) >= maxUDPSources {
+			lastSeq = make(map[string]uint64)
+		}
+		lastSeq[src] = seq
+	}
+}
+
+// maxUDPSources is the number of datagram sources tracked for lost datagram
+// detection.
+const maxUDPSources = 10000
+
+// decodeDatagram passes the messages of the datagram data to msgs and returns
+// its sequence number.
+func decodeDatagram(data []byte, msgs chan msgInfo) (uint64, error) {
+	if len(data) < udpHdrLen || string(data[:4]) != udpMagic {
+		return 0, errors.New("invalid header")
+	}
+	seq := binary.LittleEndian.Uint64(data[4:])
+	if int(data[12]) >= len(udpCodecs) {
+		return 0, errors.Errorf("invalid codec %d", data[12])
+	}
+	dec := codecs[udpCodecs[data[12]]].decode
+
+	// decode all messages before passing them to msgs
+	var ms []msgInfo
+	for data = data[udpHdrLen:]; len(data) > 0; {
+		if len(data) < 4 {
+			return 0, errors.New("truncated message length")
+		}
+		l := int(binary.LittleEndian.Uint32(data))
+		if l > len(data)-4 {
+			return 0, errors.New("truncated message")
+		}
+		var m msgInfo
+		if err := dec(&m.msg, data[4:4+l]); err != nil {
+			return 0, err
+		}
+		if err := checkMsg(&m.msg); err != nil {
+			return 0, err
+		}
+		m.len = 4 + l
+		if authorize(nil, &m.msg) == nil {
+			ms = append(ms, m)
+		}
+		data = data[4+l:]
+	}
+	for _, m := range ms {
+		enqueue(msgs, m)
+	}
+	return seq, nil
+}
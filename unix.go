@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// peerCred holds the credentials of the process connected to a Unix socket.
+type peerCred struct {
+	pid, uid, gid int32
+}
+
+// listenUnix returns a listener on the Unix socket path with the given file
+// mode and owner. The owner is given as user[:group], by name or id.
+func listenUnix(path string, mode string, owner string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid socket mode '%s'", mode)
+	}
+	uid, gid, err := lookupOwner(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	// remove a socket left by a previous run
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, os.FileMode(perm)); err == nil && (uid >= 0 || gid >= 0) {
+		err = os.Chown(path, uid, gid)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	log.Println("listen unix:", path)
+	return listener, nil
+}
+
+// lookupOwner returns the user and group ids of owner given as user[:group].
+// An id is -1 when not specified.
+func lookupOwner(owner string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	if owner == "" {
+		return uid, gid, nil
+	}
+	usr, grp := owner, ""
+	if i := strings.IndexByte(owner, ':'); i >= 0 {
+		usr, grp = owner[:i], owner[i+1:]
+	}
+	if usr != "" {
+		if uid, err = strconv.Atoi(usr); err != nil {
+			u, err := user.Lookup(usr)
+			if err != nil {
+				return -1, -1, errors.Wrap(err, "socket owner")
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+	if grp != "" {
+		if gid, err = strconv.Atoi(grp); err != nil {
+			g, err := user.LookupGroup(grp)
+			if err != nil {
+				return -1, -1, errors.Wrap(err, "socket group")
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"time"
+
+	"github.com/chmike/go-dmon/dmon"
+	"github.com/pkg/errors"
+)
+
+// levels are the valid message levels in increasing severity.
+var levels = []string{"debug", "info", "warn", "error", "fatal"}
+
+// Maximum field lengths, as stored in the database.
+const (
+	maxSystemLen    = 128
+	maxComponentLen = 64
+	maxMessageLen   = 256
+)
+
+// checkMsg returns an error if m is not a valid message. A zero time stamp
+// is set to the current time.
+func checkMsg(m *dmon.Msg) error {
+	if levelRank(m.Level) < 0 {
+		return errors.Errorf("invalid level '%s'", m.Level)
+	}
+	if m.System == "" || len(m.System) > maxSystemLen {
+		return errors.Errorf("system must have 1 to %d bytes", maxSystemLen)
+	}
+	if len(m.Component) > maxComponentLen {
+		return errors.Errorf("component longer than %d bytes", maxComponentLen)
+	}
+	if len(m.Message) > maxMessageLen {
+		return errors.Errorf("message longer than %d bytes", maxMessageLen)
+	}
+	if m.Stamp.IsZero() {
+		m.Stamp = time.Now().UTC()
+	}
+	return nil
+}
+
+// levelRank returns the index of level in levels, or -1 if it is not a valid
+// level.
+func levelRank(level string) int {
+	for i, l := range levels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The WebSocket transport carries the DMON frames in binary WebSocket
+// messages. A wsConn is a net.Conn reading the concatenated payload of the
+// received messages and sending each Write in one message, so that the
+// connection is handled exactly as a TCP connection.
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// maxWSControlLen is the maximum payload length of a control frame.
+const maxWSControlLen = 125
+
+// wsConn is a WebSocket connection seen as a byte stream.
+type wsConn struct {
+	net.Conn
+	br     *bufio.Reader
+	client bool // client frames are masked
+	mtx    sync.Mutex
+	left   uint64 // bytes left to read in the current frame
+	mask   [4]byte
+	masked bool
+	pos    int // position in the mask
+	closed bool
+}
+
+// Read reads the payload of the received data frames.
+func (c *wsConn) Read(p []byte) (int, error) {
+	for c.left == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.br.Read(p)
+	c.unmask(p[:n])
+	c.left -= uint64(n)
+	return n, err
+}
+
+// Write sends p in a binary message.
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(wsBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends a close frame and closes the connection.
+func (c *wsConn) Close() error {
+	c.writeFrame(wsClose, nil)
+	return c.Conn.Close()
+}
+
+// nextFrame reads the header of the next frame and handles control frames.
+func (c *wsConn) nextFrame() error {
+	var hdr [8]byte
+	if _, err := io.ReadFull(c.br, hdr[:2]); err != nil {
+		return err
+	}
+	opcode := hdr[0] & 0x0F
+	c.masked = hdr[1]&0x80 != 0
+	if c.masked == c.client {
+		return errors.New("websocket: invalid frame masking")
+	}
+	c.left = uint64(hdr[1] & 0x7F)
+	switch c.left {
+	case 126:
+		if _, err := io.ReadFull(c.br, hdr[:2]); err != nil {
+			return err
+		}
+		c.left = uint64(binary.BigEndian.Uint16(hdr[:2]))
+	case 127:
+		if _, err := io.ReadFull(c.br, hdr[:8]); err != nil {
+			return err
+		}
+		c.left = binary.BigEndian.Uint64(hdr[:8])
+	}
+	if c.masked {
+		if _, err := io.ReadFull(c.br, c.mask[:]); err != nil {
+			return err
+		}
+	}
+	c.pos = 0
+
+	switch opcode {
+	case wsBinary, wsContinuation:
+		return nil
+	case wsClose, wsPing, wsPong:
+		if c.left > maxWSControlLen {
+			return errors.New("websocket: control frame too long")
+		}
+		payload := make([]byte, c.left)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+		c.left = 0
+		if opcode == wsClose {
+			c.writeFrame(wsClose, nil)
+			return io.EOF
+		}
+		if opcode == wsPing {
+			return c.writeFrame(wsPong, payload)
+		}
+		return nil
+	}
+	return errors.Errorf("websocket: unsupported opcode %d", opcode)
+}
+
+// unmask unmasks the payload bytes in p.
+func (c *wsConn) unmask(p []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range p {
+		p[i] ^= c.mask[c.pos&3]
+		c.pos++
+	}
+}
+
+// writeFrame sends a frame with the opcode and the payload p.
+func (c *wsConn) writeFrame(opcode byte, p []byte) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.closed {
+		return errors.New("websocket: connection closed")
+	}
+	if opcode == wsClose {
+		c.closed = true
+	}
+	buf := make([]byte, 2, 14+len(p))
+	buf[0] = 0x80 | opcode
+	switch {
+	case len(p) < 126:
+		buf[1] = byte(len(p))
+	case len(p) <= 0xFFFF:
+		buf[1] = 126
+		buf = append(buf, 0, 0)
+		binary.BigEndian.PutUint16(buf[2:], uint16(len(p)))
+	default:
+		buf[1] = 127
+		buf = append(buf, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(buf[2:], uint64(len(p)))
+	}
+	if !c.client {
+		buf = append(buf, p...)
+	} else {
+		var mask [4]byte
+		rand.Read(mask[:])
+		buf[1] |= 0x80
+		buf = append(buf, mask[:]...)
+		for i, b := range p {
+			buf = append(buf, b^mask[i&3])
+		}
+	}
+	_, err := c.Conn.Write(buf)
+	return err
+}
+
+// wsAccept returns the Sec-WebSocket-Accept value for key.
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// wsHandler upgrades the HTTP requests to WebSocket connections handled as
+// DMON connections.
+type wsHandler struct {
+	msgs    chan msgInfo
+	limiter *connLimiter
+}
+
+func (h *wsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		log.Println("websocket hijack error:", err)
+		return
+	}
+	if err = h.limiter.acquire(conn.RemoteAddr()); err != nil {
+		log.Printf("refused connection from %s: %s", conn.RemoteAddr(), err)
+		brw.WriteString("HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\n\r\n")
+		brw.Flush()
+		conn.Close()
+		return
+	}
+	defer h.limiter.release(conn.RemoteAddr())
+	conn.SetDeadline(time.Time{})
+	brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	brw.WriteString("Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n")
+	if err = brw.Flush(); err != nil {
+		log.Println("websocket upgrade error:", err)
+		conn.Close()
+		return
+	}
+	handleClient(&wsConn{Conn: conn, br: brw.Reader}, h.msgs)
+}
+
+// dialWebSocket opens a WebSocket connection to address given as
+// host:port/path. The connection uses TLS when config is not nil.
+func dialWebSocket(address string, config *tls.Config) (net.Conn, error) {
+	host, path := address, "/"
+	if i := strings.IndexByte(address, '/'); i >= 0 {
+		host, path = address[:i], address[i:]
+	}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if config != nil {
+		conn, err = tls.Dial("tcp", host, config)
+	} else {
+		conn, err = net.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req := "GET " + path + " HTTP/1.1\r\nHost: " + host + "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	conn.SetDeadline(time.Now().Add(timeOutDelay))
+	if _, err = conn.Write([]byte(req)); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "websocket upgrade")
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "websocket upgrade")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		conn.Close()
+		return nil, errors.Errorf("websocket upgrade: unexpected response '%s'", resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return &wsConn{Conn: conn, br: br, client: true}, nil
+}